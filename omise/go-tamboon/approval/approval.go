@@ -0,0 +1,146 @@
+package approval
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-tamboon/client"
+	"go-tamboon/money"
+	"go-tamboon/processor"
+	"os"
+	"slices"
+	"time"
+)
+
+// Approval authorises one run over specific input: the contents of its
+// files, the number of donations and their total, and the key mode. It is
+// signed with HMAC-SHA256 so that an unattended run can be confirmed by an
+// approval that a person created after reviewing the preview.
+type Approval struct {
+	Mode      client.KeyMode `json:"mode"`
+	Files     []File         `json:"files"`
+	Donations int            `json:"donations"`
+	Total     money.Amount   `json:"total"`
+	Approved  time.Time      `json:"approved_at"`
+	Expires   time.Time      `json:"expires_at"`
+	Signature string         `json:"signature"`
+}
+
+// File is an approved input file. Files are matched by content, so an
+// approval still holds after its files are copied or renamed.
+type File struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// New returns an unsigned approval for what preview would charge from files,
+// valid from now for validFor.
+func New(preview *client.Preview, files []processor.InputFile, now time.Time, validFor time.Duration) *Approval {
+	a := &Approval{
+		Mode:      preview.Mode,
+		Donations: preview.Donations,
+		Total:     preview.Total,
+		Approved:  now.UTC(),
+		Expires:   now.Add(validFor).UTC(),
+	}
+	for _, f := range files {
+		a.Files = append(a.Files, File{Path: f.Path, SHA256: f.SHA256})
+	}
+	return a
+}
+
+// Sign sets the approval's signature.
+func (a *Approval) Sign(key []byte) error {
+	mac, err := a.mac(key)
+	if err != nil {
+		return err
+	}
+	a.Signature = hex.EncodeToString(mac)
+	return nil
+}
+
+// Check verifies the signature and that the approval covers exactly what
+// preview would charge from files at time now.
+func (a *Approval) Check(key []byte, preview *client.Preview, files []processor.InputFile, now time.Time) error {
+	want, err := a.mac(key)
+	if err != nil {
+		return err
+	}
+	got, err := hex.DecodeString(a.Signature)
+	if err != nil || !hmac.Equal(got, want) {
+		return fmt.Errorf("approval signature is invalid")
+	}
+
+	switch {
+	case now.After(a.Expires):
+		return fmt.Errorf("approval expired at %s", a.Expires.Local().Format(time.DateTime))
+	case a.Mode != preview.Mode:
+		return fmt.Errorf("approval is for %s keys, not %s keys", a.Mode, preview.Mode)
+	case !slices.Equal(approvedHashes(a.Files), inputHashes(files)):
+		return fmt.Errorf("approval is for different input files")
+	case a.Donations != preview.Donations || a.Total != preview.Total:
+		return fmt.Errorf("approval is for %d donations totalling %s, input has %d totalling %s",
+			a.Donations, a.Total, preview.Donations, preview.Total)
+	}
+	return nil
+}
+
+// mac signs every field but the signature itself.
+func (a *Approval) mac(key []byte) ([]byte, error) {
+	if len(key) < minKeyLength {
+		return nil, fmt.Errorf("approval key must be at least %d bytes", minKeyLength)
+	}
+	unsigned := *a
+	unsigned.Signature = ""
+	payload, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(payload)
+	return h.Sum(nil), nil
+}
+
+// Load reads an approval written by Save.
+func Load(path string) (*Approval, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading approval: %v", err)
+	}
+	var a Approval
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, fmt.Errorf("reading approval: %v", err)
+	}
+	return &a, nil
+}
+
+func (a *Approval) Save(path string) error {
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(b, '\n'), 0600); err != nil {
+		return fmt.Errorf("writing approval: %v", err)
+	}
+	return nil
+}
+
+func approvedHashes(files []File) []string {
+	var hashes []string
+	for _, f := range files {
+		hashes = append(hashes, f.SHA256)
+	}
+	slices.Sort(hashes)
+	return hashes
+}
+
+func inputHashes(files []processor.InputFile) []string {
+	var hashes []string
+	for _, f := range files {
+		hashes = append(hashes, f.SHA256)
+	}
+	slices.Sort(hashes)
+	return hashes
+}
@@ -0,0 +1,83 @@
+package approval
+
+import (
+	"go-tamboon/client"
+	"go-tamboon/money"
+	"go-tamboon/processor"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApproval(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	now := time.Date(2026, time.October, 19, 9, 0, 0, 0, time.UTC)
+	preview := &client.Preview{Mode: client.KeyModeTest, Donations: 2, Total: money.New(150000, "THB")}
+	files := []processor.InputFile{
+		{Path: "a.rot128", SHA256: "aaa"},
+		{Path: "b.rot128", SHA256: "bbb"},
+	}
+
+	a := New(preview, files, now, time.Hour)
+	if err := a.Sign(key); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "approval.json")
+	if err := a.Save(path); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	renamed := []processor.InputFile{
+		{Path: "copy/b.rot128", SHA256: "bbb"},
+		{Path: "copy/a.rot128", SHA256: "aaa"},
+	}
+	tampered := *loaded
+	tampered.Total = money.New(1, "THB")
+
+	cases := []struct {
+		name     string
+		approval *Approval
+		key      []byte
+		preview  *client.Preview
+		files    []processor.InputFile
+		now      time.Time
+		wantErr  string
+	}{
+		{name: "valid", approval: loaded, key: key, preview: preview, files: files, now: now},
+		{name: "renamed files", approval: loaded, key: key, preview: preview, files: renamed, now: now},
+		{name: "wrong key", approval: loaded, key: []byte("fedcba9876543210"), preview: preview, files: files, now: now, wantErr: "signature is invalid"},
+		{name: "short key", approval: loaded, key: []byte("short"), preview: preview, files: files, now: now, wantErr: "at least 16 bytes"},
+		{name: "tampered", approval: &tampered, key: key, preview: preview, files: files, now: now, wantErr: "signature is invalid"},
+		{name: "expired", approval: loaded, key: key, preview: preview, files: files, now: now.Add(2 * time.Hour), wantErr: "expired"},
+		{name: "other mode", approval: loaded, key: key, preview: &client.Preview{Mode: client.KeyModeLive, Donations: 2, Total: preview.Total}, files: files, now: now, wantErr: "for test keys, not live keys"},
+		{name: "changed file", approval: loaded, key: key, preview: preview, files: []processor.InputFile{files[0], {Path: "b.rot128", SHA256: "ccc"}}, now: now, wantErr: "different input files"},
+		{name: "missing file", approval: loaded, key: key, preview: preview, files: files[:1], now: now, wantErr: "different input files"},
+		{name: "changed total", approval: loaded, key: key, preview: &client.Preview{Mode: client.KeyModeTest, Donations: 2, Total: money.New(150001, "THB")}, files: files, now: now, wantErr: "2 donations totalling"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.approval.Check(c.key, c.preview, c.files, c.now)
+			if c.wantErr == "" {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", c.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSignRequiresKey(t *testing.T) {
+	a := New(&client.Preview{}, nil, time.Now(), time.Hour)
+	if err := a.Sign(nil); err == nil {
+		t.Error("Expected signing without a key to fail")
+	}
+}
@@ -0,0 +1,4 @@
+package approval
+
+// minKeyLength is the shortest APPROVAL_KEY accepted, in bytes.
+const minKeyLength = 16
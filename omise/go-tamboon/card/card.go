@@ -0,0 +1,142 @@
+package card
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Brand string
+
+const (
+	Unknown    Brand = ""
+	Visa       Brand = "Visa"
+	Mastercard Brand = "MasterCard"
+	JCB        Brand = "JCB"
+	Amex       Brand = "American Express"
+	UnionPay   Brand = "UnionPay"
+)
+
+type Reason string
+
+const (
+	ReasonInvalidNumber   Reason = "invalid_number"
+	ReasonUnknownBrand    Reason = "unknown_brand"
+	ReasonInvalidLength   Reason = "invalid_length"
+	ReasonInvalidChecksum Reason = "invalid_checksum"
+	ReasonInvalidCVV      Reason = "invalid_security_code"
+	ReasonExpired         Reason = "expired_card"
+)
+
+type ValidationError struct {
+	Reason Reason
+	Brand  Brand
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, reasonMessages[e.Reason])
+}
+
+func Validate(number, cvv string, month, year int, now time.Time) (Brand, error) {
+	if !isDigits(number) {
+		return Unknown, &ValidationError{Reason: ReasonInvalidNumber}
+	}
+
+	brand := DetectBrand(number)
+	rule, ok := brandRules[brand]
+	if !ok {
+		return Unknown, &ValidationError{Reason: ReasonUnknownBrand}
+	}
+	if !containsInt(rule.lengths, len(number)) {
+		return brand, &ValidationError{Reason: ReasonInvalidLength, Brand: brand}
+	}
+	if rule.luhn && !Luhn(number) {
+		return brand, &ValidationError{Reason: ReasonInvalidChecksum, Brand: brand}
+	}
+	if !isDigits(cvv) || len(cvv) != rule.cvvLength {
+		return brand, &ValidationError{Reason: ReasonInvalidCVV, Brand: brand}
+	}
+	if Expired(month, year, now) {
+		return brand, &ValidationError{Reason: ReasonExpired, Brand: brand}
+	}
+
+	return brand, nil
+}
+
+func DetectBrand(number string) Brand {
+	switch {
+	case strings.HasPrefix(number, "4"):
+		return Visa
+	case prefixInRange(number, 2, 51, 55), prefixInRange(number, 4, 2221, 2720):
+		return Mastercard
+	case strings.HasPrefix(number, "34"), strings.HasPrefix(number, "37"):
+		return Amex
+	case prefixInRange(number, 4, 3528, 3589):
+		return JCB
+	case strings.HasPrefix(number, "62"):
+		return UnionPay
+	}
+	return Unknown
+}
+
+func Luhn(number string) bool {
+	if !isDigits(number) {
+		return false
+	}
+
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// Expired reports whether a card expiring at the end of the given month is
+// no longer usable at now.
+func Expired(month, year int, now time.Time) bool {
+	if year != now.Year() {
+		return year < now.Year()
+	}
+	return month < int(now.Month())
+}
+
+func prefixInRange(number string, digits, low, high int) bool {
+	if len(number) < digits {
+		return false
+	}
+	prefix := 0
+	for i := 0; i < digits; i++ {
+		prefix = prefix*10 + int(number[i]-'0')
+	}
+	return prefix >= low && prefix <= high
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func containsInt(values []int, v int) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package card
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+func TestDetectBrand(t *testing.T) {
+	cases := []struct {
+		number string
+		brand  Brand
+	}{
+		{"4242424242424242", Visa},
+		{"5555555555554444", Mastercard},
+		{"2223003122003222", Mastercard},
+		{"378282246310005", Amex},
+		{"341111111111111", Amex},
+		{"3530111333300000", JCB},
+		{"6200000000000005", UnionPay},
+		{"6011111111111117", Unknown},
+		{"0000000000000000", Unknown},
+		{"", Unknown},
+	}
+
+	for _, c := range cases {
+		if got := DetectBrand(c.number); got != c.brand {
+			t.Errorf("DetectBrand(%s): expected %q, got %q", c.number, c.brand, got)
+		}
+	}
+}
+
+func TestLuhn(t *testing.T) {
+	cases := map[string]bool{
+		"4242424242424242": true,
+		"4000000000000002": true,
+		"378282246310005":  true,
+		"4242424242424241": false,
+		"42424242x4242424": false,
+		"":                 false,
+	}
+
+	for number, want := range cases {
+		if got := Luhn(number); got != want {
+			t.Errorf("Luhn(%s): expected %v, got %v", number, want, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		number string
+		cvv    string
+		month  int
+		year   int
+		brand  Brand
+		reason Reason
+	}{
+		{name: "valid visa", number: "4242424242424242", cvv: "123", month: 12, year: 2030, brand: Visa},
+		{name: "valid amex", number: "378282246310005", cvv: "1234", month: 1, year: 2030, brand: Amex},
+		{name: "current month is still valid", number: "4242424242424242", cvv: "123", month: 10, year: 2026, brand: Visa},
+		{name: "valid unionpay without luhn", number: "6200000000000006", cvv: "123", month: 12, year: 2030, brand: UnionPay},
+		{name: "non digits", number: "4242-4242-4242-4242", cvv: "123", month: 12, year: 2030, reason: ReasonInvalidNumber},
+		{name: "unknown brand", number: "0000000000000000", cvv: "123", month: 12, year: 2030, reason: ReasonUnknownBrand},
+		{name: "bad length", number: "42424242424242", cvv: "123", month: 12, year: 2030, brand: Visa, reason: ReasonInvalidLength},
+		{name: "bad checksum", number: "4242424242424241", cvv: "123", month: 12, year: 2030, brand: Visa, reason: ReasonInvalidChecksum},
+		{name: "amex needs four digit cvv", number: "378282246310005", cvv: "123", month: 12, year: 2030, brand: Amex, reason: ReasonInvalidCVV},
+		{name: "visa needs three digit cvv", number: "4242424242424242", cvv: "1234", month: 12, year: 2030, brand: Visa, reason: ReasonInvalidCVV},
+		{name: "expired last month", number: "4242424242424242", cvv: "123", month: 9, year: 2026, brand: Visa, reason: ReasonExpired},
+		{name: "expired last year", number: "4242424242424242", cvv: "123", month: 12, year: 2025, brand: Visa, reason: ReasonExpired},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			brand, err := Validate(c.number, c.cvv, c.month, c.year, now)
+			if brand != c.brand {
+				t.Errorf("Expected brand %q, got %q", c.brand, brand)
+			}
+
+			if c.reason == "" {
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				return
+			}
+
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("Expected ValidationError, got %v", err)
+			}
+			if validationErr.Reason != c.reason {
+				t.Errorf("Expected reason %s, got %s", c.reason, validationErr.Reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package card
+
+type brandRule struct {
+	lengths   []int
+	cvvLength int
+	luhn      bool
+}
+
+var brandRules = map[Brand]brandRule{
+	Visa:       {lengths: []int{13, 16, 19}, cvvLength: 3, luhn: true},
+	Mastercard: {lengths: []int{16}, cvvLength: 3, luhn: true},
+	Amex:       {lengths: []int{15}, cvvLength: 4, luhn: true},
+	JCB:        {lengths: []int{16, 17, 18, 19}, cvvLength: 3, luhn: true},
+	// Some UnionPay ranges are issued without a Luhn check digit.
+	UnionPay: {lengths: []int{16, 17, 18, 19}, cvvLength: 3, luhn: false},
+}
+
+var reasonMessages = map[Reason]string{
+	ReasonInvalidNumber:   "card number must contain only digits",
+	ReasonUnknownBrand:    "card brand is not supported",
+	ReasonInvalidLength:   "card number length does not match the brand",
+	ReasonInvalidChecksum: "card number fails the Luhn check",
+	ReasonInvalidCVV:      "security code length does not match the brand",
+	ReasonExpired:         "card has expired",
+}
@@ -33,9 +33,17 @@ func NewRot128Writer(w io.Writer) (*Rot128Writer, error) {
 }
 
 func (w *Rot128Writer) Write(p []byte) (int, error) {
-	n := copy(w.buffer, p)
-	rot128(w.buffer[:n])
-	return w.writer.Write(w.buffer[:n])
+	written := 0
+	for written < len(p) {
+		n := copy(w.buffer, p[written:])
+		rot128(w.buffer[:n])
+		m, err := w.writer.Write(w.buffer[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
 }
 
 func rot128(buf []byte) {
@@ -2,6 +2,7 @@ package cipher
 
 import (
 	"bytes"
+	"io"
 	"testing"
 
 	r "github.com/stretchr/testify/require"
@@ -67,3 +68,21 @@ func TestRot128Writer_Reversible(t *testing.T) {
 	r.Equal(t, 3, n)
 	r.Equal(t, TestBuffer, buf.Bytes())
 }
+
+func TestRot128Writer_LargeWrite(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer, err := NewRot128Writer(buf)
+	r.NoError(t, err)
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	n, err := writer.Write(data)
+	r.NoError(t, err)
+	r.Equal(t, len(data), n)
+
+	reader, err := NewRot128Reader(buf)
+	r.NoError(t, err)
+	out := make([]byte, len(data))
+	_, err = io.ReadFull(reader, out)
+	r.NoError(t, err)
+	r.Equal(t, data, out)
+}
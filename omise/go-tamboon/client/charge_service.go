@@ -1,8 +1,12 @@
 package client
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"go-tamboon/metrics"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -11,7 +15,8 @@ import (
 )
 
 type ChargeService struct {
-	chargeURL string
+	chargeURL  string
+	httpClient *http.Client
 }
 
 func NewChargeService() *ChargeService {
@@ -20,11 +25,12 @@ func NewChargeService() *ChargeService {
 		chargeURL = defaultChargeURL
 	}
 	return &ChargeService{
-		chargeURL: chargeURL,
+		chargeURL:  chargeURL,
+		httpClient: newHTTPClient(),
 	}
 }
 
-func (cs *ChargeService) CreateCharge(amount, tokenID, description string) error {
+func (cs *ChargeService) CreateCharge(ctx context.Context, amount, tokenID, description string) (string, error) {
 	data := url.Values{}
 	data.Set("description", description)
 	data.Set("amount", amount)
@@ -32,44 +38,56 @@ func (cs *ChargeService) CreateCharge(amount, tokenID, description string) error
 	data.Set("return_uri", returnURI)
 	data.Set("card", tokenID)
 
-	req, err := http.NewRequest("POST", cs.chargeURL, strings.NewReader(data.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", cs.chargeURL, strings.NewReader(data.Encode()))
 	if err != nil {
-		return fmt.Errorf("error creating charge request: %v", err)
+		return "", fmt.Errorf("error creating charge request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.SetBasicAuth(os.Getenv("OMISE_SKEY"), "")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	start := time.Now()
+	resp, err := cs.httpClient.Do(req)
+	metrics.ObserveRequest(metrics.EndpointCharge, start)
 	if err != nil {
-		return fmt.Errorf("error making charge request: %v", err)
+		return "", fmt.Errorf("error making charge request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("error reading charge response: %v", err)
+		return "", fmt.Errorf("error reading charge response: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		errorMsg := parseOmiseError(body)
-		return fmt.Errorf("API error: %s", errorMsg)
+		return "", parseAPIError(resp.StatusCode, body)
 	}
 
-	return nil
+	// The charge went through whatever the body says, so a missing ID must
+	// not turn it into a failure that could be retried and charged twice.
+	var chargeResponse map[string]interface{}
+	if err := json.Unmarshal(body, &chargeResponse); err != nil {
+		slog.Warn("could not parse charge response", "error", err)
+		return "", nil
+	}
+	chargeID, _ := chargeResponse["id"].(string)
+	return chargeID, nil
 }
 
-func (cs *ChargeService) CreateChargeWithRateLimit(amount, tokenID, description string, rl *RateLimiter) error {
+func (cs *ChargeService) CreateChargeWithRateLimit(ctx context.Context, amount, tokenID, description string, rl *RateLimiter, onRetry func(attempt int, wait time.Duration, err error)) (string, error) {
 	retries := 0
 	for {
-		err := cs.CreateCharge(amount, tokenID, description)
+		chargeID, err := cs.CreateCharge(ctx, amount, tokenID, description)
 		if err != nil && isRateLimitError(err) {
 			if retries >= maxRetries {
-				return fmt.Errorf("rate limit: exceeded max retries")
+				return "", fmt.Errorf("rate limit: exceeded max retries")
+			}
+			metrics.Retries.WithLabelValues(metrics.EndpointCharge).Inc()
+			waitTime := time.Duration(retries+1) * retryBaseWait
+			if onRetry != nil {
+				onRetry(retries+1, waitTime, err)
 			}
 			rl.Pause()
-			waitTime := time.Duration(5*(retries+1)) * time.Second
 			go func() {
 				time.Sleep(waitTime)
 				rl.Resume()
@@ -78,6 +96,6 @@ func (cs *ChargeService) CreateChargeWithRateLimit(amount, tokenID, description
 			retries++
 			continue
 		}
-		return err
+		return chargeID, err
 	}
 }
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"errors"
+	"go-tamboon/metrics"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ConcurrencyLimiter bounds how many requests a pipeline stage has in
+// flight. The limit grows by one after each limit's worth of healthy
+// responses and halves on a rate limit, a server or network error, or when
+// latency climbs well above the best seen so far. A limiter whose bounds
+// are equal never moves.
+type ConcurrencyLimiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	endpoint string
+	limit    int
+	min      int
+	max      int
+	peak     int
+	inFlight int
+	healthy  int
+	cooldown int
+	latency  time.Duration
+	baseline time.Duration
+}
+
+func NewConcurrencyLimiter(endpoint string, initial, lower, upper int) *ConcurrencyLimiter {
+	lower = max(lower, 1)
+	upper = max(upper, lower)
+	initial = clamp(initial, lower, upper)
+	l := &ConcurrencyLimiter{endpoint: endpoint, limit: initial, min: lower, max: upper, peak: initial}
+	l.cond = sync.NewCond(&l.mu)
+	metrics.ConcurrencyLimit.WithLabelValues(endpoint).Set(float64(initial))
+	return l
+}
+
+func newStageConcurrency(endpoint string, workers int) *ConcurrencyLimiter {
+	if concurrencyMode == concurrencyModeAdaptive {
+		return NewConcurrencyLimiter(endpoint, workers, minWorkers, maxWorkers)
+	}
+	return NewConcurrencyLimiter(endpoint, workers, workers, workers)
+}
+
+func (l *ConcurrencyLimiter) Acquire() {
+	l.mu.Lock()
+	for l.inFlight >= l.limit {
+		l.cond.Wait()
+	}
+	l.inFlight++
+	l.mu.Unlock()
+}
+
+func (l *ConcurrencyLimiter) Release() {
+	l.mu.Lock()
+	l.inFlight--
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+// Observe feeds the outcome of one request into the limit. Errors that say
+// nothing about the host's health, such as a declined card, are ignored.
+func (l *ConcurrencyLimiter) Observe(latency time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.cooldown > 0 {
+		l.cooldown--
+	}
+	if isOverloadError(err) {
+		l.decrease()
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	if l.latency == 0 {
+		l.latency = latency
+	} else {
+		l.latency += time.Duration(latencySmoothing * float64(latency-l.latency))
+	}
+	if l.baseline == 0 || l.latency < l.baseline {
+		l.baseline = l.latency
+	}
+
+	if float64(l.latency) > latencyTolerance*float64(l.baseline) {
+		if l.decrease() {
+			// Let the baseline follow a host that has become slower for good.
+			l.baseline += (l.latency - l.baseline) / 2
+		}
+		return
+	}
+
+	l.healthy++
+	if l.cooldown == 0 && l.healthy >= l.limit && l.limit < l.max {
+		l.healthy = 0
+		l.setLimit(l.limit + 1)
+	}
+}
+
+// Backoff halves the limit straight away, for signals that arrive before a
+// request completes such as a 429 that is about to be retried.
+func (l *ConcurrencyLimiter) Backoff() {
+	l.mu.Lock()
+	l.decrease()
+	l.mu.Unlock()
+}
+
+func (l *ConcurrencyLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+func (l *ConcurrencyLimiter) Peak() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.peak
+}
+
+// decrease ignores further signals until the requests already in flight at
+// the old limit have completed, so one burst of 429s only halves once.
+func (l *ConcurrencyLimiter) decrease() bool {
+	l.healthy = 0
+	if l.cooldown > 0 {
+		return false
+	}
+	l.cooldown = l.limit
+	l.setLimit(max(l.limit/2, l.min))
+	return true
+}
+
+func (l *ConcurrencyLimiter) setLimit(limit int) {
+	if limit == l.limit {
+		return
+	}
+	l.limit = limit
+	l.peak = max(l.peak, limit)
+	metrics.ConcurrencyLimit.WithLabelValues(l.endpoint).Set(float64(limit))
+	l.cond.Broadcast()
+}
+
+func isOverloadError(err error) bool {
+	var apiErr *APIError
+	var urlErr *url.Error
+	switch {
+	case err == nil:
+		return false
+	case isRateLimitError(err), errors.As(err, &urlErr):
+		return true
+	case errors.As(err, &apiErr):
+		return apiErr.StatusCode >= 500
+	}
+	return false
+}
+
+func clamp(n, lo, hi int) int {
+	return min(max(n, lo), hi)
+}
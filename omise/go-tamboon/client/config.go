@@ -3,16 +3,84 @@ package client
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var (
 	maxRetries            = defaultMaxRetries
 	maxDonationGoroutines = defaultMaxDonationGoroutines
+	tokenWorkers          = defaultMaxDonationGoroutines
+	chargeWorkers         = defaultMaxDonationGoroutines
+	tokenQueueSize        = defaultQueueSize
+	chargeQueueSize       = defaultQueueSize
+	tokenRPS              = 0
+	chargeRPS             = 0
+	concurrencyMode       = concurrencyModeFixed
+	minWorkers            = defaultMinWorkers
+	maxWorkers            = defaultMaxWorkers
+	currency              = defaultCurrency
+	liveModeEnabled       = false
+	retryBaseWait         = defaultRetryBaseWait
+	topDonors             = defaultTopDonors
+	sizeBuckets           = parseSizeBuckets(defaultSizeBuckets)
+	duplicatePolicy       = duplicatePolicyWarn
+	duplicateWindow       = defaultDuplicateWindow
+	minDonation           = -1
+	maxDonation           = 0
+	maxRunTotal           = 0
+	maxDonorTotal         = 0
 )
 
 func InitConfig() {
 	maxRetries = getEnvInt("MAX_RETRIES", defaultMaxRetries)
 	maxDonationGoroutines = getEnvInt("MAX_DONATION_GOROUTINES", defaultMaxDonationGoroutines)
+	tokenWorkers = getEnvInt("TOKEN_WORKERS", maxDonationGoroutines)
+	chargeWorkers = getEnvInt("CHARGE_WORKERS", maxDonationGoroutines)
+	tokenQueueSize = getEnvInt("TOKEN_QUEUE_SIZE", defaultQueueSize)
+	chargeQueueSize = getEnvInt("CHARGE_QUEUE_SIZE", defaultQueueSize)
+	tokenRPS = getEnvInt("TOKEN_RPS", 0)
+	chargeRPS = getEnvInt("CHARGE_RPS", 0)
+	concurrencyMode = strings.ToLower(getEnvString("CONCURRENCY_MODE", concurrencyModeFixed))
+	minWorkers = getEnvInt("MIN_WORKERS", defaultMinWorkers)
+	maxWorkers = getEnvInt("MAX_WORKERS", defaultMaxWorkers)
+	currency = strings.ToUpper(getEnvString("OMISE_CURRENCY", defaultCurrency))
+	if topDonors = getEnvInt("TOP_DONORS", defaultTopDonors); topDonors < 0 {
+		topDonors = defaultTopDonors
+	}
+	if buckets := parseSizeBuckets(getEnvString("SIZE_BUCKETS", defaultSizeBuckets)); buckets != nil {
+		sizeBuckets = buckets
+	}
+	duplicatePolicy = parseDuplicatePolicy(getEnvString("DUPLICATE_ROWS", duplicatePolicyWarn))
+	duplicateWindow = getEnvDuration("DUPLICATE_WINDOW", defaultDuplicateWindow)
+	minDonation = getEnvInt("MIN_DONATION", -1)
+	maxDonation = getEnvInt("MAX_DONATION", 0)
+	maxRunTotal = getEnvInt("MAX_RUN_TOTAL", 0)
+	maxDonorTotal = getEnvInt("MAX_DONOR_TOTAL", 0)
+}
+
+// parseDuplicatePolicy reads DUPLICATE_ROWS, falling back to warning about
+// duplicates for an unknown policy so that none goes unnoticed.
+func parseDuplicatePolicy(policy string) string {
+	switch policy = strings.ToLower(policy); policy {
+	case duplicatePolicySkip, duplicatePolicyCharge:
+		return policy
+	}
+	return duplicatePolicyWarn
+}
+
+// parseSizeBuckets reads ascending bucket boundaries in whole units of the
+// currency, e.g. "100,1000". It returns nil if any boundary is invalid.
+func parseSizeBuckets(spec string) []int64 {
+	var bounds []int64
+	for _, field := range strings.Split(spec, ",") {
+		bound, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+		if err != nil || bound <= 0 || (len(bounds) > 0 && bound <= bounds[len(bounds)-1]) {
+			return nil
+		}
+		bounds = append(bounds, bound)
+	}
+	return bounds
 }
 
 func getEnvInt(key string, defaultVal int) int {
@@ -23,3 +91,19 @@ func getEnvInt(key string, defaultVal int) int {
 	}
 	return defaultVal
 }
+
+func getEnvDuration(key string, defaultVal time.Duration) time.Duration {
+	if val, ok := os.LookupEnv(key); ok {
+		if d, err := time.ParseDuration(val); err == nil && d >= 0 {
+			return d
+		}
+	}
+	return defaultVal
+}
+
+func getEnvString(key string, defaultVal string) string {
+	if val, ok := os.LookupEnv(key); ok && val != "" {
+		return val
+	}
+	return defaultVal
+}
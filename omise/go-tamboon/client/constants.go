@@ -1,11 +1,84 @@
 package client
 
+import "time"
+
 const (
 	defaultMaxRetries            = 5
+	defaultRetryBaseWait         = 5 * time.Second
 	defaultMaxDonationGoroutines = 4
+	defaultQueueSize             = 16
+	defaultMinWorkers            = 1
+	defaultMaxWorkers            = 32
+	defaultTopDonors             = 3
+	defaultSizeBuckets           = "100,1000,10000"
+	defaultDuplicateWindow       = 24 * time.Hour
+
+	concurrencyModeFixed    = "fixed"
+	concurrencyModeAdaptive = "adaptive"
+	latencySmoothing        = 0.2
+	latencyTolerance        = 2.0
+
+	defaultTokenURL      = "https://vault.omise.co/tokens"
+	defaultChargeURL     = "https://api.omise.co/charges"
+	defaultAccountURL    = "https://api.omise.co/account"
+	defaultCapabilityURL = "https://api.omise.co/capability"
+	defaultCurrency      = "THB"
+	returnURI            = "http://www.example.com/orders/complete"
+
+	publicKeyPrefix = "pkey_"
+	secretKeyPrefix = "skey_"
+
+	preflightTimeout  = 10 * time.Second
+	cardPaymentMethod = "card"
+
+	errorCodeRateLimit         = "rate_limit_exceeded"
+	errorCodeNetwork           = "network_error"
+	errorCodeChargeUnconfirmed = "charge_unconfirmed"
+	errorCodeUnknown           = "unknown"
+
+	rejectReasonMalformed = "malformed_row"
+
+	duplicatePolicySkip   = "skip"
+	duplicatePolicyWarn   = "warn"
+	duplicatePolicyCharge = "charge"
+	reasonDuplicate       = "duplicate"
 
-	defaultTokenURL  = "https://vault.omise.co/tokens"
-	defaultChargeURL = "https://api.omise.co/charges"
-	currency         = "THB"
-	returnURI        = "http://www.example.com/orders/complete"
+	limitMinDonation = "below_minimum"
+	limitMaxDonation = "above_maximum"
+	limitRunTotal    = "run_total_cap"
+	limitDonorTotal  = "donor_total_cap"
+
+	donorIDFingerprint = "card:"
+	donorIDName        = "name:"
+
+	errorCodeInsufficientFund = "insufficient_fund"
+	errorCodeFailedProcessing = "failed_processing"
+
+	percentileMedian = 50
+
+	summaryFormatText = "text"
+	summaryFormatJSON = "json"
+
+	langEnglish        = "en"
+	langThai           = "th"
+	builtinTemplateDir = "templates"
+	previewTemplate    = "preview"
+
+	minExpiryYear = 2000
+	maxExpiryYear = 2099
 )
+
+// omiseMinimums are the smallest charges Omise accepts, in the minor unit of
+// each currency. MIN_DONATION defaults to these.
+var omiseMinimums = map[string]int64{
+	"THB": 2000,
+	"JPY": 100,
+	"SGD": 100,
+	"MYR": 200,
+	"USD": 100,
+	"EUR": 100,
+	"GBP": 100,
+}
+
+// percentiles are the donation sizes reported in every summary.
+var percentiles = []int{percentileMedian, 90, 99}
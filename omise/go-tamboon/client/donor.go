@@ -0,0 +1,70 @@
+package client
+
+import (
+	"cmp"
+	"go-tamboon/money"
+	"slices"
+	"strings"
+)
+
+// donorID identifies the person behind a donation by the card fingerprint
+// when the vault returned one, otherwise by their normalised name, so the
+// same card counts as one donor whatever name it was given.
+func donorID(name, fingerprint string) string {
+	if fingerprint != "" {
+		return donorIDFingerprint + fingerprint
+	}
+	return donorIDName + normalizeName(name)
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(collapseSpaces(name))
+}
+
+func collapseSpaces(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+func (d donorTallies) add(id, name string, amount money.Amount) {
+	t, ok := d[id]
+	if !ok {
+		t = &donorTally{names: make(map[string]int)}
+		d[id] = t
+	}
+	t.amount = plus(t.amount, amount)
+	t.donations++
+	t.names[collapseSpaces(name)]++
+}
+
+func (d donorTallies) merge(other donorTallies) {
+	for id, o := range other {
+		t, ok := d[id]
+		if !ok {
+			t = &donorTally{names: make(map[string]int)}
+			d[id] = t
+		}
+		t.amount = plus(t.amount, o.amount)
+		t.donations += o.donations
+		for name, count := range o.names {
+			t.names[name] += count
+		}
+	}
+}
+
+// totals lists every donor by amount donated, largest first. A donor is
+// shown under the name they used most often.
+func (d donorTallies) totals() []DonorTotal {
+	donors := make([]DonorTotal, 0, len(d))
+	for id, t := range d {
+		names := make([]string, 0, len(t.names))
+		for name := range t.names {
+			names = append(names, name)
+		}
+		slices.SortFunc(names, func(a, b string) int {
+			return cmp.Or(cmp.Compare(t.names[b], t.names[a]), cmp.Compare(a, b))
+		})
+		donors = append(donors, DonorTotal{ID: id, Name: names[0], Names: names, Amount: t.amount, Donations: t.donations})
+	}
+	sortDonors(donors)
+	return donors
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"go-tamboon/metrics"
+	"go-tamboon/money"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ChargeHistory looks up donations charged by earlier runs, so a row
+// repeated across runs is caught as well as one repeated within a run.
+type ChargeHistory interface {
+	// PreviousCharge returns the ID of a donation charged with mode keys at
+	// or after since, by donorID, for amount and under name ignoring case
+	// and spacing, or "" if there is none.
+	PreviousCharge(mode KeyMode, donorID string, amount money.Amount, name string, since time.Time) (string, error)
+}
+
+// SetChargeHistory checks every donation against h before charging it, as
+// DUPLICATE_ROWS and DUPLICATE_WINDOW configure.
+func (c *OmiseClient) SetChargeHistory(h ChargeHistory) {
+	c.chargeHistory = h
+}
+
+type duplicateKey struct {
+	fingerprint string
+	name        string
+	amount      money.Amount
+}
+
+// duplicateRows remembers the donations of one run by card fingerprint,
+// amount and name, mapped to the ID of the first donation with that key.
+type duplicateRows struct {
+	mu   sync.Mutex
+	seen map[duplicateKey]string
+}
+
+func newDuplicateRows() *duplicateRows {
+	return &duplicateRows{seen: make(map[duplicateKey]string)}
+}
+
+// claim returns the ID of an earlier donation that job repeats, from this run
+// or from history. Otherwise job becomes the donation later ones repeat.
+// Donations without a card fingerprint are never duplicates.
+func (d *duplicateRows) claim(job *donationJob, mode KeyMode, history ChargeHistory) string {
+	r := job.record
+	if job.token.Fingerprint == "" {
+		return ""
+	}
+	key := duplicateKey{fingerprint: job.token.Fingerprint, name: normalizeName(r.Name), amount: r.Amount}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if id, ok := d.seen[key]; ok {
+		return id
+	}
+	d.seen[key] = r.ID()
+
+	if history == nil {
+		return ""
+	}
+	id, err := history.PreviousCharge(mode, donorID(r.Name, job.token.Fingerprint), r.Amount, r.Name, time.Now().Add(-duplicateWindow))
+	if err != nil {
+		slog.Warn("could not check donation history", "donation_id", r.ID(), "error", err)
+		return ""
+	}
+	return id
+}
+
+// release forgets job after its charge failed, so a later row with the same
+// card, amount and name is charged instead of being treated as a duplicate.
+func (d *duplicateRows) release(job *donationJob) {
+	key := duplicateKey{fingerprint: job.token.Fingerprint, name: normalizeName(job.record.Name), amount: job.record.Amount}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen[key] == job.record.ID() {
+		delete(d.seen, key)
+	}
+}
+
+// skipDuplicate looks job up among the donations already charged and reports
+// whether DUPLICATE_ROWS says to skip it. A skipped donation is recorded and
+// quarantined here.
+func (c *OmiseClient) skipDuplicate(p *pipeline, job *donationJob) bool {
+	if duplicatePolicy == duplicatePolicyCharge {
+		return false
+	}
+	job.duplicateOf = p.duplicates.claim(job, c.keyMode, c.chargeHistory)
+	if job.duplicateOf == "" {
+		return false
+	}
+
+	r := job.record
+	metrics.DuplicateDonations.WithLabelValues(duplicatePolicy).Inc()
+	slog.Warn("duplicate donation", "row", r.Line, "donation_id", r.ID(),
+		"duplicate_of", job.duplicateOf, "policy", duplicatePolicy)
+	if duplicatePolicy != duplicatePolicySkip {
+		return false
+	}
+
+	endSpan(job.span, nil)
+	c.progress.Failed()
+	job.stats.record(job, OutcomeDuplicate, reasonDuplicate, nil)
+	c.emitDonation(EventChargeFailed, r, "", reasonDuplicate, nil)
+	c.quarantineRow(r, reasonDuplicate, false)
+	return true
+}
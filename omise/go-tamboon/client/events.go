@@ -0,0 +1,107 @@
+package client
+
+import (
+	"go-tamboon/logging"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventRowParsed        EventType = "row_parsed"
+	EventTokenCreated     EventType = "token_created"
+	EventChargeCreated    EventType = "charge_created"
+	EventChargeFailed     EventType = "charge_failed"
+	EventRetryScheduled   EventType = "retry_scheduled"
+	EventRateLimitPaused  EventType = "rate_limit_paused"
+	EventRateLimitResumed EventType = "rate_limit_resumed"
+)
+
+// Event describes one step of a donation run. Donation fields are empty for
+// rate limiter events, which apply to a whole endpoint. Card is masked and
+// Error is redacted.
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	DonationID string
+	Source     string
+	Line       int
+	Name       string
+	Amount     Amount
+	Card       string
+	Endpoint   string
+	Attempt    int
+	Wait       time.Duration
+	Code       string
+	Error      string
+	Transforms []string
+}
+
+// Observer receives events as a run progresses. Events for one donation are
+// delivered in order, from row_parsed to charge_created or charge_failed, but
+// different donations are observed concurrently, so OnEvent must be safe to
+// call from several goroutines. A slow observer slows the run down.
+type Observer interface {
+	OnEvent(Event)
+}
+
+type ObserverFunc func(Event)
+
+func (f ObserverFunc) OnEvent(e Event) { f(e) }
+
+// AddObserver registers o for every following run. It must not be called
+// while a run is in progress.
+func (c *OmiseClient) AddObserver(o Observer) {
+	c.observers = append(c.observers, o)
+}
+
+func (c *OmiseClient) emit(e Event) {
+	if len(c.observers) == 0 {
+		return
+	}
+	e.Time = time.Now()
+	for _, o := range c.observers {
+		o.OnEvent(e)
+	}
+}
+
+func (c *OmiseClient) emitDonation(eventType EventType, r DonationRecord, endpoint, code string, err error) {
+	if len(c.observers) == 0 {
+		return
+	}
+	e := Event{
+		Type: eventType, DonationID: r.ID(), Source: r.Source, Line: r.Line, Name: r.Name,
+		Amount: r.Amount, Card: r.Card.String(), Endpoint: endpoint, Code: code, Transforms: r.Transforms,
+	}
+	if err != nil {
+		e.Error = logging.Redact(err.Error())
+	}
+	c.emit(e)
+}
+
+func (c *OmiseClient) retryObserver(r DonationRecord, endpoint string) func(attempt int, wait time.Duration, err error) {
+	return func(attempt int, wait time.Duration, err error) {
+		if len(c.observers) == 0 {
+			return
+		}
+		e := Event{
+			Type: EventRetryScheduled, DonationID: r.ID(), Source: r.Source, Line: r.Line, Name: r.Name,
+			Amount: r.Amount, Card: r.Card.String(), Endpoint: endpoint, Attempt: attempt, Wait: wait,
+			Code: errorCode(err), Error: logging.Redact(err.Error()),
+		}
+		c.emit(e)
+	}
+}
+
+// newObservedLimiter returns the rate limiter for a stage, which backs off
+// the stage's concurrency and notifies observers when it pauses.
+func (c *OmiseClient) newObservedLimiter(endpoint string, rps int, concurrency *ConcurrencyLimiter) *RateLimiter {
+	onPause := func() {
+		concurrency.Backoff()
+		c.emit(Event{Type: EventRateLimitPaused, Endpoint: endpoint})
+	}
+	onResume := func(paused time.Duration) {
+		c.emit(Event{Type: EventRateLimitResumed, Endpoint: endpoint, Wait: paused})
+	}
+	return newStageLimiter(rps, onPause, onResume)
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type KeyMode string
+
+const (
+	KeyModeUnknown KeyMode = "unknown"
+	KeyModeTest    KeyMode = "test"
+	KeyModeLive    KeyMode = "live"
+)
+
+func ClassifyKey(key string) KeyMode {
+	switch {
+	case strings.HasPrefix(key, publicKeyPrefix+"test_"), strings.HasPrefix(key, secretKeyPrefix+"test_"):
+		return KeyModeTest
+	case strings.HasPrefix(key, publicKeyPrefix+"live_"), strings.HasPrefix(key, secretKeyPrefix+"live_"):
+		return KeyModeLive
+	}
+	return KeyModeUnknown
+}
+
+func CurrentKeyMode() (KeyMode, error) {
+	pkeyMode := ClassifyKey(os.Getenv("OMISE_PKEY"))
+	skeyMode := ClassifyKey(os.Getenv("OMISE_SKEY"))
+
+	if pkeyMode == KeyModeLive || skeyMode == KeyModeLive {
+		if pkeyMode != skeyMode {
+			return KeyModeUnknown, fmt.Errorf("OMISE_PKEY is a %s key but OMISE_SKEY is a %s key", pkeyMode, skeyMode)
+		}
+		return KeyModeLive, nil
+	}
+	if pkeyMode == KeyModeTest && skeyMode == KeyModeTest {
+		return KeyModeTest, nil
+	}
+	return KeyModeUnknown, nil
+}
+
+func EnableLiveMode() {
+	liveModeEnabled = true
+}
+
+func checkKeyMode(mode KeyMode, tokenURL, chargeURL string) error {
+	if mode != KeyModeLive {
+		return nil
+	}
+	if !liveModeEnabled {
+		return fmt.Errorf("live keys detected: rerun with --live to charge real cards")
+	}
+	if tokenURL != defaultTokenURL || chargeURL != defaultChargeURL {
+		return fmt.Errorf("custom Omise endpoints are test-only and cannot be used with live keys")
+	}
+	return nil
+}
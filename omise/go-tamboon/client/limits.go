@@ -0,0 +1,150 @@
+package client
+
+import (
+	"fmt"
+	"go-tamboon/metrics"
+	"go-tamboon/money"
+	"log/slog"
+	"math"
+	"sync"
+)
+
+// LimitError is why a donation was held back instead of charged. Cap is the
+// limit in effect and Amount what the donation, or the total it would have
+// brought the run or donor to, came to.
+type LimitError struct {
+	Limit  string
+	Amount money.Amount
+	Cap    money.Amount
+}
+
+func (e *LimitError) Error() string {
+	switch e.Limit {
+	case limitMinDonation:
+		return fmt.Sprintf("donation of %s is below the minimum of %s", e.Amount, e.Cap)
+	case limitMaxDonation:
+		return fmt.Sprintf("donation of %s is above the maximum of %s", e.Amount, e.Cap)
+	case limitDonorTotal:
+		return fmt.Sprintf("donor total would reach %s, over the cap of %s", e.Amount, e.Cap)
+	}
+	return fmt.Sprintf("run total would reach %s, over the cap of %s", e.Amount, e.Cap)
+}
+
+// spendingLimits holds back donations that would take a run past its
+// ceilings. Amounts are reserved before a donation is charged and released
+// again if it fails, so concurrent donations cannot overshoot a cap together.
+type spendingLimits struct {
+	mu      sync.Mutex
+	total   money.Amount
+	reached bool
+	donors  map[string]money.Amount
+}
+
+func newSpendingLimits() *spendingLimits {
+	return &spendingLimits{donors: make(map[string]money.Amount)}
+}
+
+// admit checks a donation against the per-donation limits and reserves it in
+// the run total. Once a donation would take the run past MAX_RUN_TOTAL no
+// further donation is admitted, however small.
+func (l *spendingLimits) admit(job *donationJob) *LimitError {
+	amount := job.record.Amount
+	if minimum := minDonationAmount(amount.Currency); amount.Subunits < minimum.Subunits {
+		return &LimitError{Limit: limitMinDonation, Amount: amount, Cap: minimum}
+	}
+	if maxDonation > 0 {
+		if maximum := wholeUnits(int64(maxDonation), amount.Currency); amount.Subunits > maximum.Subunits {
+			return &LimitError{Limit: limitMaxDonation, Amount: amount, Cap: maximum}
+		}
+	}
+	if maxRunTotal <= 0 {
+		return nil
+	}
+
+	ceiling := wholeUnits(int64(maxRunTotal), amount.Currency)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	total, err := l.total.Add(amount)
+	if l.reached || err != nil || total.Subunits > ceiling.Subunits {
+		l.reached = true
+		return &LimitError{Limit: limitRunTotal, Amount: total, Cap: ceiling}
+	}
+	l.total = total
+	job.reservedRun = true
+	return nil
+}
+
+// admitDonor reserves a tokenized donation in its donor's total, which is
+// only known once the vault has returned the card fingerprint.
+func (l *spendingLimits) admitDonor(job *donationJob) *LimitError {
+	if maxDonorTotal <= 0 {
+		return nil
+	}
+	amount := job.record.Amount
+	id := donorID(job.record.Name, job.token.Fingerprint)
+	ceiling := wholeUnits(int64(maxDonorTotal), amount.Currency)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	total, err := l.donors[id].Add(amount)
+	if err != nil || total.Subunits > ceiling.Subunits {
+		return &LimitError{Limit: limitDonorTotal, Amount: total, Cap: ceiling}
+	}
+	l.donors[id] = total
+	job.reservedDonor = true
+	return nil
+}
+
+// release gives back what job reserved, after it failed or was held back by
+// a later check.
+func (l *spendingLimits) release(job *donationJob) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if job.reservedRun {
+		l.total = minus(l.total, job.record.Amount)
+		job.reservedRun = false
+	}
+	if job.reservedDonor {
+		id := donorID(job.record.Name, job.token.Fingerprint)
+		l.donors[id] = minus(l.donors[id], job.record.Amount)
+		job.reservedDonor = false
+	}
+}
+
+// hold records a donation that a spending limit kept from being charged.
+func (c *OmiseClient) hold(job *donationJob, err *LimitError) {
+	r := job.record
+	metrics.RowsRejected.WithLabelValues(err.Limit).Inc()
+	slog.Warn("held back donation", "row", r.Line, "donation_id", r.ID(), "limit", err.Limit, "reason", err.Error())
+	c.progress.Failed()
+	job.stats.record(job, OutcomeHeld, err.Limit, err)
+	c.emitDonation(EventChargeFailed, r, "", err.Limit, err)
+	c.quarantineRow(r, err.Limit, IsRetryable(err))
+}
+
+// minDonationAmount is MIN_DONATION, or Omise's minimum charge for currency
+// when MIN_DONATION is not set.
+func minDonationAmount(currency string) money.Amount {
+	if minDonation >= 0 {
+		return wholeUnits(int64(minDonation), currency)
+	}
+	return money.New(omiseMinimums[currency], currency)
+}
+
+// wholeUnits converts an amount configured in whole units of currency, such
+// as baht, to its minor unit.
+func wholeUnits(n int64, currency string) money.Amount {
+	amount, err := money.New(n, currency).Mul(pow10(money.Exponent(currency)), 1)
+	if err != nil {
+		return money.New(math.MaxInt64, currency)
+	}
+	return amount
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for range n {
+		p *= 10
+	}
+	return p
+}
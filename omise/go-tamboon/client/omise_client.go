@@ -1,75 +1,262 @@
 package client
 
 import (
+	"errors"
 	"fmt"
-	"log"
-	"strconv"
+	"go-tamboon/card"
+	"go-tamboon/logging"
+	"go-tamboon/metrics"
+	"go-tamboon/money"
+	"go-tamboon/progress"
+	"log/slog"
 	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func (c *OmiseClient) ProcessDonationsStream(recordCh <-chan DonationRecord) {
-	s := &donationStats{
-		donorAmounts: make(map[string]int64),
+// ProcessDonationsStream charges every donation read from recordCh and
+// returns once all of them have finished.
+func (c *OmiseClient) ProcessDonationsStream(recordCh <-chan DonationRecord) *RunResult {
+	started := time.Now()
+	s := newDonationStats()
+	c.processStream(recordCh, s)
+	c.progress.Stop()
+	return c.newRunResult(s, started)
+}
+
+// ProcessDonationFiles charges the donations in every file through one
+// shared pipeline. A file that cannot be opened is reported in its
+// FileResult without stopping the others; the error is only set when a
+// malformed row aborted the run, in which case the result is still valid.
+func (c *OmiseClient) ProcessDonationFiles(paths []string, open RecordSource) (*RunResult, error) {
+	started := time.Now()
+	fileStats := make([]*donationStats, len(paths))
+	var streams []<-chan DonationRecord
+	var streamStats []*donationStats
+
+	for i, path := range paths {
+		fileStats[i] = newDonationStats()
+		recordCh, err := open(path)
+		if err != nil {
+			slog.Error("could not open donation file", "file", path, "error", err)
+			fileStats[i].err = err
+			continue
+		}
+		streams = append(streams, recordCh)
+		streamStats = append(streamStats, fileStats[i])
 	}
+	c.run(streams, streamStats)
+	c.progress.Stop()
 
-	var wg sync.WaitGroup
-	sem := make(chan struct{}, maxDonationGoroutines)
+	total := newDonationStats()
+	for _, s := range fileStats {
+		total.merge(s)
+	}
 
-	for record := range recordCh {
-		amount, _ := strconv.ParseInt(record.AmountSubunits, 10, 64)
+	result := c.newRunResult(total, started)
+	for i, s := range fileStats {
+		file := FileResult{Path: paths[i], Summary: s.summary()}
+		if s.err != nil {
+			file.Error = s.err.Error()
+		}
+		result.Files = append(result.Files, file)
+	}
 
-		s.mu.Lock()
-		s.totalCount++
-		s.totalAmount += amount
-		s.mu.Unlock()
+	if total.abort != nil {
+		return result, fmt.Errorf("aborted on malformed row: %v", total.abort)
+	}
+	return result, nil
+}
+
+func (c *OmiseClient) processStream(recordCh <-chan DonationRecord, s *donationStats) {
+	c.run([]<-chan DonationRecord{recordCh}, []*donationStats{s})
+}
+
+// run feeds every stream into one shared pipeline and returns once all of
+// their donations have finished.
+func (c *OmiseClient) run(streams []<-chan DonationRecord, stats []*donationStats) {
+	p := c.startPipeline()
+	received := &runningTotal{}
 
+	var wg sync.WaitGroup
+	for i, recordCh := range streams {
 		wg.Add(1)
-		sem <- struct{}{}
-		go func(r DonationRecord, amt int64) {
+		go func(ch <-chan DonationRecord, s *donationStats) {
 			defer wg.Done()
-			defer func() { <-sem }()
+			c.feed(ch, s, p, received)
+		}(recordCh, stats[i])
+	}
+	wg.Wait()
+	p.close()
+}
 
-			err := c.processSingleDonation(r)
+// feed schedules the donations of one stream. A row that aborts the run
+// stops every stream of that run from scheduling further donations.
+func (c *OmiseClient) feed(recordCh <-chan DonationRecord, s *donationStats, p *pipeline, received *runningTotal) {
+	for record := range recordCh {
+		if p.aborted.Load() {
+			continue
+		}
+		c.progress.RowRead()
+
+		if record.Reject == nil {
+			if err := received.add(record.Amount); err != nil {
+				record.Reject = &RowError{Line: record.Line, FieldCount: record.Row.Len(), Reason: err.Error()}
+			}
+		}
 
+		if record.Reject != nil {
+			c.progress.Failed()
+			metrics.RowsRejected.WithLabelValues(rejectReasonMalformed).Inc()
+			slog.Warn("rejected malformed row", "file", record.Source, "row", record.Line,
+				"fields", record.Reject.FieldCount, "reason", record.Reject.Reason, "abort", record.Reject.Abort)
 			s.mu.Lock()
-			if err != nil {
-				log.Printf("Error processing donation for %s: %v", r.Name, err)
-			} else {
-				s.successCount++
-				s.successAmount += amt
-				s.donorAmounts[r.Name] += amt
+			s.rejected = append(s.rejected, *record.Reject)
+			if record.Reject.Abort {
+				s.abort = record.Reject
+				p.aborted.Store(true)
 			}
 			s.mu.Unlock()
-		}(record, amount)
+			c.quarantineRow(record, record.Reject.Reason, false)
+			continue
+		}
+
+		s.mu.Lock()
+		s.totalCount++
+		s.totalAmount = plus(s.totalAmount, record.Amount)
+		s.mu.Unlock()
+		c.emitDonation(EventRowParsed, record, "", "", nil)
+		if len(record.Transforms) > 0 {
+			slog.Debug("transformed row", "row", record.Line, "donation_id", record.ID(), "transforms", record.Transforms)
+		}
+
+		if err := preValidate(record); err != nil {
+			metrics.RowsRejected.WithLabelValues(string(err.Reason)).Inc()
+			slog.Warn("pre-rejected donation", "row", record.Line, "donation_id", record.ID(),
+				"reason", string(err.Reason), "brand", string(err.Brand))
+			s.mu.Lock()
+			s.preRejected[err.Reason]++
+			s.mu.Unlock()
+			s.record(&donationJob{record: record}, OutcomePreRejected, string(err.Reason), nil)
+			c.emitDonation(EventChargeFailed, record, "", string(err.Reason), err)
+			c.quarantineRow(record, string(err.Reason), false)
+			c.progress.Failed()
+			continue
+		}
+
+		job := &donationJob{record: record, stats: s}
+		if limitErr := p.limits.admit(job); limitErr != nil {
+			c.hold(job, limitErr)
+			continue
+		}
+		p.tokens <- job
 	}
+}
 
-	wg.Wait()
-	printSummary(s)
+// SetProgress feeds per-row outcomes and rate limiter pauses to p.
+func (c *OmiseClient) SetProgress(p *progress.Reporter) {
+	c.progress = p
+	p.SetPauseSource(c.limiterStats)
 }
 
-func NewOmiseClient() *OmiseClient {
-	return &OmiseClient{
-		tokenService:  NewTokenService(),
-		chargeService: NewChargeService(),
-		rateLimiter:   NewRateLimiter(),
-	}
+func (c *OmiseClient) limiterStats() (pauses int, pausedTotal time.Duration) {
+	tokenPauses, tokenPaused := c.tokenLimiter.Stats()
+	chargePauses, chargePaused := c.chargeLimiter.Stats()
+	return tokenPauses + chargePauses, tokenPaused + chargePaused
 }
 
-func (c *OmiseClient) processSingleDonation(record DonationRecord) error {
-	c.rateLimiter.WaitIfPaused()
-	tokenID, err := c.tokenService.CreateTokenWithRateLimit(
-		record.Name, record.CCNumber, record.CVV, record.ExpMonth, record.ExpYear, c.rateLimiter)
+func NewOmiseClient() (*OmiseClient, error) {
+	mode, err := CurrentKeyMode()
 	if err != nil {
-		return fmt.Errorf("creating token: %v", err)
+		return nil, err
+	}
+
+	tokenService := NewTokenService()
+	chargeService := NewChargeService()
+	if err := checkKeyMode(mode, tokenService.tokenURL, chargeService.chargeURL); err != nil {
+		return nil, err
 	}
 
-	c.rateLimiter.WaitIfPaused()
-	description := fmt.Sprintf("charge for %s", record.Name)
-	err = c.chargeService.CreateChargeWithRateLimit(
-		record.AmountSubunits, tokenID, description, c.rateLimiter)
+	tokenConcurrency := newStageConcurrency(metrics.EndpointToken, tokenWorkers)
+	chargeConcurrency := newStageConcurrency(metrics.EndpointCharge, chargeWorkers)
+
+	c := &OmiseClient{
+		tokenService:      tokenService,
+		chargeService:     chargeService,
+		tokenConcurrency:  tokenConcurrency,
+		chargeConcurrency: chargeConcurrency,
+		keyMode:           mode,
+	}
+	c.tokenLimiter = c.newObservedLimiter(metrics.EndpointToken, tokenRPS, tokenConcurrency)
+	c.chargeLimiter = c.newObservedLimiter(metrics.EndpointCharge, chargeRPS, chargeConcurrency)
+	return c, nil
+}
+
+func (c *OmiseClient) concurrency() []*ConcurrencyLimiter {
+	return []*ConcurrencyLimiter{c.tokenConcurrency, c.chargeConcurrency}
+}
+
+func (c *OmiseClient) KeyMode() KeyMode {
+	return c.keyMode
+}
+
+func endSpan(span trace.Span, err error) {
 	if err != nil {
-		return fmt.Errorf("creating charge: %v", err)
+		span.SetStatus(codes.Error, logging.Redact(err.Error()))
+	}
+	span.End()
+}
+
+func preValidate(record DonationRecord) *card.ValidationError {
+	_, err := card.Validate(record.Card.Number(), record.Card.CVV(),
+		record.Expiry.Month, record.Expiry.Year, time.Now())
+
+	var validationErr *card.ValidationError
+	if errors.As(err, &validationErr) {
+		return validationErr
 	}
+	return nil
+}
 
+func (t *runningTotal) add(amount money.Amount) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sum, err := t.amount.Add(amount)
+	if err != nil {
+		return fmt.Errorf("amount would overflow the run total: %v", err)
+	}
+	t.amount = sum
 	return nil
 }
+
+// plus adds amounts that are bounded by a run's runningTotal and so cannot
+// overflow.
+func plus(a, b money.Amount) money.Amount {
+	sum, _ := a.Add(b)
+	return sum
+}
+
+func newDonationStats() *donationStats {
+	return &donationStats{
+		donors:      make(donorTallies),
+		preRejected: make(map[card.Reason]int),
+	}
+}
+
+func (s *donationStats) merge(other *donationStats) {
+	s.totalCount += other.totalCount
+	s.totalAmount = plus(s.totalAmount, other.totalAmount)
+	s.successCount += other.successCount
+	s.successAmount = plus(s.successAmount, other.successAmount)
+	s.donors.merge(other.donors)
+	for reason, count := range other.preRejected {
+		s.preRejected[reason] += count
+	}
+	s.rejected = append(s.rejected, other.rejected...)
+	s.outcomes = append(s.outcomes, other.outcomes...)
+	if s.abort == nil {
+		s.abort = other.abort
+	}
+}
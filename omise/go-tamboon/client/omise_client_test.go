@@ -2,13 +2,38 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"go-tamboon/card"
+	"go-tamboon/display"
+	"go-tamboon/logging"
+	"go-tamboon/metrics"
+	"go-tamboon/money"
 	"io"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestCreateToken(t *testing.T) {
@@ -16,8 +41,9 @@ func TestCreateToken(t *testing.T) {
 		"object": "token",
 		"id":     "tokn_test_123456789",
 		"card": map[string]interface{}{
-			"name": "John Doe",
-			"city": "Bangkok",
+			"name":        "John Doe",
+			"city":        "Bangkok",
+			"fingerprint": "XjOdjaoHRvUGRfmZacMPcJtm0U3SEIIfkA7534dQeVw=",
 		},
 	}
 
@@ -62,13 +88,16 @@ func TestCreateToken(t *testing.T) {
 
 	client := NewOmiseClientWithURLs(server.URL+"/tokens", "https://api.omise.co/charges")
 
-	tokenID, err := client.CreateToken("John Doe", "4242424242424242", "123", "12", "2025")
+	token, err := client.CreateToken("John Doe", "4242424242424242", "123", "12", "2025")
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 
-	if tokenID != "tokn_test_123456789" {
-		t.Errorf("Expected token ID 'tokn_test_123456789', got %s", tokenID)
+	if token.ID != "tokn_test_123456789" {
+		t.Errorf("Expected token ID 'tokn_test_123456789', got %s", token.ID)
+	}
+	if token.Fingerprint != "XjOdjaoHRvUGRfmZacMPcJtm0U3SEIIfkA7534dQeVw=" {
+		t.Errorf("Expected the card fingerprint, got %q", token.Fingerprint)
 	}
 }
 
@@ -108,16 +137,19 @@ func TestCreateCharge(t *testing.T) {
 
 	client := NewOmiseClientWithURLs("https://vault.omise.co/tokens", server.URL+"/charges")
 
-	err := client.CreateCharge("100000", "tokn_test_123456789", "John Doe")
+	chargeID, err := client.CreateCharge("100000", "tokn_test_123456789", "John Doe")
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
+	if chargeID != "chrg_test_123456789" {
+		t.Errorf("Expected charge ID 'chrg_test_123456789', got %q", chargeID)
+	}
 }
 
 func TestProcessDonationsStream(t *testing.T) {
 	records := []DonationRecord{
-		{Name: "John Doe", AmountSubunits: "100000", CCNumber: "4242424242424242", CVV: "123", ExpMonth: "12", ExpYear: "2025"},
-		{Name: "Jane Smith", AmountSubunits: "200000", CCNumber: "5555555555554444", CVV: "456", ExpMonth: "11", ExpYear: "2026"},
+		{Name: "John Doe", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 12, Year: 2030}},
+		{Name: "Jane Smith", Amount: Amount{Subunits: 200000, Currency: "THB"}, Card: NewCard("5555555555554444", "456"), Expiry: Expiry{Month: 11, Year: 2031}},
 	}
 
 	mockTokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -148,141 +180,1986 @@ func TestProcessDonationsStream(t *testing.T) {
 		close(recordCh)
 	}()
 
-	client.ProcessDonationsStream(recordCh)
+	result := client.ProcessDonationsStream(recordCh)
+
+	if result.Mode != KeyModeUnknown || result.Currency != "THB" || result.Files != nil {
+		t.Errorf("Unexpected run metadata %+v", result)
+	}
+	if result.Donations != 2 || result.Succeeded != 2 || result.Received.Subunits != 300000 || result.Donated.Subunits != 300000 || result.Faulty.Subunits != 0 {
+		t.Errorf("Unexpected totals %+v", result.Summary)
+	}
+	expectedDonors := []DonorTotal{
+		{ID: "name:jane smith", Name: "Jane Smith", Names: []string{"Jane Smith"}, Amount: Amount{Subunits: 200000, Currency: "THB"}, Donations: 1},
+		{ID: "name:john doe", Name: "John Doe", Names: []string{"John Doe"}, Amount: Amount{Subunits: 100000, Currency: "THB"}, Donations: 1},
+	}
+	if !reflect.DeepEqual(result.Donors, expectedDonors) {
+		t.Errorf("Expected donors %+v, got %+v", expectedDonors, result.Donors)
+	}
+	if len(result.Outcomes) != 2 || len(result.Failures()) != 0 {
+		t.Errorf("Expected 2 successful outcomes, got %+v", result.Outcomes)
+	}
 }
 
-func (c *OmiseClient) CreateToken(name, ccNumber, cvv, expMonth, expYear string) (string, error) {
-	return c.tokenService.CreateToken(name, ccNumber, cvv, expMonth, expYear)
+func TestRunResultOutcomes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.URL.Path == "/tokens":
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_" + r.FormValue("card[name]")})
+		case r.FormValue("card") == "tokn_Declined":
+			w.WriteHeader(http.StatusPaymentRequired)
+			w.Write([]byte(`{"object": "error", "code": "insufficient_fund", "message": "card 4242424242424242 has insufficient funds"}`))
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "charge", "id": "chrg_test_123456789"})
+		}
+	}))
+	defer server.Close()
+
+	client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+	recordCh := make(chan DonationRecord, 4)
+	recordCh <- DonationRecord{Source: "a.rot128", Line: 4, Name: "Paid", Amount: Amount{Subunits: 30000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}, Transforms: []string{"shift_expiry"}}
+	recordCh <- DonationRecord{Source: "a.rot128", Line: 2, Name: "Declined", Amount: Amount{Subunits: 50000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Source: "a.rot128", Line: 3, Name: "Expired", Amount: Amount{Subunits: 10000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2020}}
+	recordCh <- DonationRecord{Source: "a.rot128", Line: 5, Name: "Paid", Amount: Amount{Subunits: 20000, Currency: "THB"}, Card: NewCard("5555555555554444", "456"), Expiry: Expiry{Month: 1, Year: 2030}}
+	close(recordCh)
+
+	result := client.ProcessDonationsStream(recordCh)
+
+	var outcomes []string
+	for _, o := range result.Outcomes {
+		outcomes = append(outcomes, fmt.Sprintf("%s %s %s", o.ID, o.Outcome, o.Reason))
+	}
+	expected := []string{
+		"a.rot128:2 failed insufficient_fund",
+		"a.rot128:3 pre_rejected expired_card",
+		"a.rot128:4 succeeded ",
+		"a.rot128:5 succeeded ",
+	}
+	if !reflect.DeepEqual(outcomes, expected) {
+		t.Errorf("Expected outcomes %v, got %v", expected, outcomes)
+	}
+
+	failures := result.Failures()
+	if len(failures) != 2 || strings.Contains(failures[0].Error, "4242424242424242") {
+		t.Errorf("Expected 2 redacted failures, got %+v", failures)
+	}
+	expectedTop := []DonorTotal{{ID: "name:paid", Name: "Paid", Names: []string{"Paid"}, Amount: Amount{Subunits: 50000, Currency: "THB"}, Donations: 2}}
+	if donors := result.TopDonors(1); !reflect.DeepEqual(donors, expectedTop) {
+		t.Errorf("Expected Paid to be the top donor with 2 donations, got %+v", donors)
+	}
+	if donors := result.TopDonors(-1); len(donors) != 0 {
+		t.Errorf("Expected no top donors for a negative count, got %+v", donors)
+	}
+	if average := result.AveragePerPerson(); result.UniqueDonors != 1 || average.Subunits != 50000 {
+		t.Errorf("Expected 1 donor averaging 50000, got %d averaging %v", result.UniqueDonors, average)
+	}
+
+	var buf bytes.Buffer
+	if err := (JSONRenderer{}).Render(&buf, result); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "4242424242424242") || strings.Contains(out, `"123"`) {
+		t.Errorf("Expected JSON summary to mask card data, got %s", out)
+	}
+	var decoded RunResult
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Expected valid JSON, got %v", err)
+	}
+	if decoded.Received != result.Received || len(decoded.Outcomes) != 4 || decoded.PreRejected[card.ReasonExpired] != 1 {
+		t.Errorf("Unexpected decoded result %+v", decoded)
+	}
+	if transforms := decoded.Outcomes[2].Transforms; !reflect.DeepEqual(transforms, []string{"shift_expiry"}) || decoded.Outcomes[3].Transforms != nil {
+		t.Errorf("Expected only line 4 to list its transforms, got %v and %v", transforms, decoded.Outcomes[3].Transforms)
+	}
 }
 
-func (c *OmiseClient) CreateCharge(amount string, tokenID, description string) error {
-	return c.chargeService.CreateCharge(amount, tokenID, description)
+func TestDonorsByFingerprint(t *testing.T) {
+	fingerprints := map[string]string{
+		"4242424242424242": "fp_visa",
+		"5555555555554444": "fp_mastercard",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path == "/tokens" {
+			card := map[string]interface{}{"name": r.FormValue("card[name]")}
+			if fp, ok := fingerprints[r.FormValue("card[number]")]; ok {
+				card["fingerprint"] = fp
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_test_123456789", "card": card})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "charge", "id": "chrg_test_123456789"})
+	}))
+	defer server.Close()
+
+	client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+	recordCh := make(chan DonationRecord, 5)
+	recordCh <- DonationRecord{Line: 2, Name: "John Smith", Amount: Amount{Subunits: 10000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Line: 3, Name: "John Smith", Amount: Amount{Subunits: 20000, Currency: "THB"}, Card: NewCard("5555555555554444", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Line: 4, Name: "Jon Smith", Amount: Amount{Subunits: 40000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Line: 5, Name: "Jane Doe", Amount: Amount{Subunits: 5000, Currency: "THB"}, Card: NewCard("4111111111111111", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Line: 6, Name: " jane  DOE", Amount: Amount{Subunits: 5000, Currency: "THB"}, Card: NewCard("4111111111111111", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	close(recordCh)
+
+	result := client.ProcessDonationsStream(recordCh)
+
+	expected := []DonorTotal{
+		{ID: "card:fp_visa", Name: "John Smith", Names: []string{"John Smith", "Jon Smith"}, Amount: Amount{Subunits: 50000, Currency: "THB"}, Donations: 2},
+		{ID: "card:fp_mastercard", Name: "John Smith", Names: []string{"John Smith"}, Amount: Amount{Subunits: 20000, Currency: "THB"}, Donations: 1},
+		{ID: "name:jane doe", Name: "Jane Doe", Names: []string{"Jane Doe", "jane DOE"}, Amount: Amount{Subunits: 10000, Currency: "THB"}, Donations: 2},
+	}
+	if !reflect.DeepEqual(result.Donors, expected) {
+		t.Errorf("Expected donors %+v, got %+v", expected, result.Donors)
+	}
+	if average := result.AveragePerPerson(); result.UniqueDonors != 3 || average.Subunits != 26667 {
+		t.Errorf("Expected 3 donors averaging 26667, got %d averaging %v", result.UniqueDonors, average)
+	}
+
+	var report bytes.Buffer
+	if err := (JSONRenderer{}).Render(&report, result); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	decoded, err := LoadRunResult(&report)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if merged := MergeRetry(decoded, &RunResult{}); !reflect.DeepEqual(merged.Donors, expected) {
+		t.Errorf("Expected donors to survive a report round trip, got %+v", merged.Donors)
+	}
 }
 
-func NewOmiseClientWithURLs(tokenURL, chargeURL string) *OmiseClient {
-	oldTokenURL := os.Getenv("OMISE_TOKEN_URL")
-	oldChargeURL := os.Getenv("OMISE_CHARGE_URL")
+// fakeChargeHistory reports one earlier charge per donor ID.
+type fakeChargeHistory map[string]string
 
-	os.Setenv("OMISE_TOKEN_URL", tokenURL)
-	os.Setenv("OMISE_CHARGE_URL", chargeURL)
+func (h fakeChargeHistory) PreviousCharge(mode KeyMode, donorID string, amount money.Amount, name string, since time.Time) (string, error) {
+	if age := time.Since(since); age < duplicateWindow || age > duplicateWindow+time.Minute {
+		return "", fmt.Errorf("unexpected lookup since %v", since)
+	}
+	return h[donorID], nil
+}
+
+func TestDuplicateDonations(t *testing.T) {
+	var charges atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path == "/tokens" {
+			card := map[string]interface{}{}
+			switch r.FormValue("card[number]") {
+			case "4242424242424242":
+				card["fingerprint"] = "fp_visa"
+			case "5555555555554444":
+				card["fingerprint"] = "fp_mastercard"
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_test_123456789", "card": card})
+			return
+		}
+		charges.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "charge", "id": "chrg_test_123456789"})
+	}))
+	defer server.Close()
 
-	client := &OmiseClient{
-		tokenService:  NewTokenService(),
-		chargeService: NewChargeService(),
-		rateLimiter:   NewRateLimiter(),
+	cases := []struct {
+		policy        string
+		wantCharges   int32
+		wantDuplicate int
+	}{
+		{policy: duplicatePolicySkip, wantCharges: 3, wantDuplicate: 2},
+		{policy: duplicatePolicyWarn, wantCharges: 5, wantDuplicate: 2},
+		{policy: duplicatePolicyCharge, wantCharges: 5, wantDuplicate: 0},
 	}
+	for _, c := range cases {
+		t.Run(c.policy, func(t *testing.T) {
+			oldPolicy := duplicatePolicy
+			duplicatePolicy = c.policy
+			defer func() { duplicatePolicy = oldPolicy }()
+			charges.Store(0)
 
-	os.Setenv("OMISE_TOKEN_URL", oldTokenURL)
-	os.Setenv("OMISE_CHARGE_URL", oldChargeURL)
+			client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+			client.SetChargeHistory(fakeChargeHistory{"card:fp_mastercard": "earlier"})
+			recordCh := make(chan DonationRecord, 5)
+			recordCh <- DonationRecord{Line: 2, Name: "Jane Doe", Amount: Amount{Subunits: 5000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+			recordCh <- DonationRecord{Line: 3, Name: " jane  DOE", Amount: Amount{Subunits: 5000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+			recordCh <- DonationRecord{Line: 4, Name: "Jane Doe", Amount: Amount{Subunits: 7000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+			recordCh <- DonationRecord{Line: 5, Name: "John Smith", Amount: Amount{Subunits: 9000, Currency: "THB"}, Card: NewCard("5555555555554444", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+			recordCh <- DonationRecord{Line: 6, Name: "Bob", Amount: Amount{Subunits: 5000, Currency: "THB"}, Card: NewCard("4111111111111111", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+			close(recordCh)
 
-	return client
+			result := client.ProcessDonationsStream(recordCh)
+			if got := charges.Load(); got != c.wantCharges {
+				t.Errorf("Expected %d charges, got %d", c.wantCharges, got)
+			}
+			if result.Duplicates != c.wantDuplicate {
+				t.Errorf("Expected %d duplicates, got %d", c.wantDuplicate, result.Duplicates)
+			}
+			if result.Succeeded != int(c.wantCharges) {
+				t.Errorf("Expected %d successful donations, got %d", c.wantCharges, result.Succeeded)
+			}
+			if c.wantDuplicate == 0 {
+				return
+			}
+
+			duplicateOf := make(map[int]string)
+			for _, o := range result.Outcomes {
+				if o.DuplicateOf != "" {
+					duplicateOf[o.Line] = o.DuplicateOf
+				}
+				if (o.Outcome == OutcomeDuplicate) != (c.policy == duplicatePolicySkip && o.DuplicateOf != "") {
+					t.Errorf("Unexpected outcome %s for line %d", o.Outcome, o.Line)
+				}
+			}
+			if duplicateOf[5] != "earlier" {
+				t.Errorf("Expected line 5 to repeat an earlier run, got %q", duplicateOf[5])
+			}
+			line2, line3 := (DonationRecord{Line: 2}).ID(), (DonationRecord{Line: 3}).ID()
+			if len(duplicateOf) != 2 || (duplicateOf[2] == line3) == (duplicateOf[3] == line2) {
+				t.Errorf("Expected one of lines 2 and 3 to repeat the other, got %v", duplicateOf)
+			}
+		})
+	}
 }
 
-func init() {
-	os.Setenv("OMISE_PKEY", "test_public_key")
-	os.Setenv("OMISE_SKEY", "test_secret_key")
+func TestUnconfirmedChargeKeepsDuplicateClaim(t *testing.T) {
+	oldPolicy := duplicatePolicy
+	duplicatePolicy = duplicatePolicySkip
+	defer func() { duplicatePolicy = oldPolicy }()
+
+	// The repeat is only tokenized once the first charge has failed, so that
+	// the test does not depend on how the two stages interleave.
+	failed := make(chan struct{})
+	var repeats atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.URL.Path == "/tokens":
+			if r.FormValue("card[name]") == "jane doe" {
+				<-failed
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_" + r.FormValue("card[name]"), "card": map[string]interface{}{"fingerprint": "fp_visa"}})
+		case r.FormValue("card") == "tokn_Jane Doe":
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"object": "error", "code": "bad_gateway", "message": "upstream timed out"}`))
+		default:
+			repeats.Add(1)
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "charge", "id": "chrg_test_123456789"})
+		}
+	}))
+	defer server.Close()
+
+	client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+	client.AddObserver(ObserverFunc(func(e Event) {
+		if e.Type == EventChargeFailed && e.Line == 2 {
+			close(failed)
+		}
+	}))
+	recordCh := make(chan DonationRecord, 2)
+	recordCh <- DonationRecord{Line: 2, Name: "Jane Doe", Amount: Amount{Subunits: 5000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Line: 3, Name: "jane doe", Amount: Amount{Subunits: 5000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	close(recordCh)
+
+	result := client.ProcessDonationsStream(recordCh)
+	if repeats.Load() != 0 || result.Duplicates != 1 {
+		t.Errorf("Expected the repeat of an unconfirmed charge to be skipped, got %d charges and %d duplicates", repeats.Load(), result.Duplicates)
+	}
+	if o := result.Outcomes[1]; o.Outcome != OutcomeDuplicate || o.DuplicateOf != result.Outcomes[0].ID {
+		t.Errorf("Expected line 3 to repeat line 2, got %+v", o)
+	}
 }
 
-func TestPrintSummary(t *testing.T) {
-	mockTokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		mockResponse := map[string]interface{}{
-			"object": "token",
-			"id":     "tokn_test_123456789",
+func TestParseDuplicatePolicy(t *testing.T) {
+	cases := map[string]string{"skip": "skip", "SKIP": "skip", "charge": "charge", "warn": "warn", "bogus": "warn", "": "warn"}
+	for in, want := range cases {
+		if got := parseDuplicatePolicy(in); got != want {
+			t.Errorf("parseDuplicatePolicy(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSummaryStatistics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.URL.Path == "/tokens":
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_" + r.FormValue("card[name]")})
+		case r.FormValue("card") == "tokn_Broke":
+			w.WriteHeader(http.StatusPaymentRequired)
+			w.Write([]byte(`{"object": "error", "code": "insufficient_fund", "message": "insufficient funds"}`))
+		case r.FormValue("card") == "tokn_Stolen":
+			w.WriteHeader(http.StatusPaymentRequired)
+			w.Write([]byte(`{"object": "error", "code": "stolen_or_lost_card", "message": "card was reported stolen"}`))
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "charge", "id": "chrg_test_123456789"})
 		}
-		json.NewEncoder(w).Encode(mockResponse)
 	}))
-	defer mockTokenServer.Close()
+	defer server.Close()
 
-	mockChargeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		mockResponse := map[string]interface{}{
-			"object": "charge",
-			"id":     "chrg_test_123456789",
+	oldTop := topDonors
+	topDonors = 2
+	defer func() { topDonors = oldTop }()
+
+	donations := []struct {
+		name     string
+		subunits int64
+	}{
+		{"Zed", 5000}, {"Amy", 150000}, {"Bob", 150000}, {"Cat", 25000},
+		{"Dan", 2000000}, {"Eve", 9000}, {"Broke", 40000}, {"Stolen", 40000},
+	}
+	client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+	recordCh := make(chan DonationRecord, len(donations))
+	for i, d := range donations {
+		recordCh <- DonationRecord{Line: i + 2, Name: d.name, Amount: Amount{Subunits: d.subunits, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	}
+	close(recordCh)
+
+	result := client.ProcessDonationsStream(recordCh)
+
+	if result.Failed != 2 || !reflect.DeepEqual(result.FailureReasons, map[string]int{"insufficient_fund": 1, "stolen_or_lost_card": 1}) {
+		t.Errorf("Expected one failure per reason, got %d %v", result.Failed, result.FailureReasons)
+	}
+	if result.SuccessRate != 0.75 {
+		t.Errorf("Expected a success rate of 0.75, got %v", result.SuccessRate)
+	}
+	var got []int64
+	for _, p := range result.Percentiles {
+		got = append(got, p.Amount.Subunits)
+	}
+	if !reflect.DeepEqual(got, []int64{25000, 2000000, 2000000}) || result.Median().Subunits != 25000 {
+		t.Errorf("Expected median 25000 and p90/p99 2000000, got %v", got)
+	}
+	var counts []int
+	for _, b := range result.SizeBuckets {
+		counts = append(counts, b.Count)
+	}
+	if !reflect.DeepEqual(counts, []int{2, 1, 2, 1}) || result.SizeBuckets[3].To != nil || result.SizeBuckets[1].To.Subunits != 100000 {
+		t.Errorf("Unexpected size buckets %+v", result.SizeBuckets)
+	}
+	if result.Duration <= 0 || result.Finished.Before(result.Started) {
+		t.Errorf("Expected the run to be timed, got %v from %v to %v", result.Duration, result.Started, result.Finished)
+	}
+
+	var buf bytes.Buffer
+	if err := (TextRenderer{}).Render(&buf, result); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	output := buf.String()
+	for _, expect := range []string{
+		"failed charges:              2",
+		"insufficient_fund: 1",
+		"success rate:          75.0%",
+		"median: THB     250.00",
+		"90th percentile: THB  20,000.00",
+		"donation sizes: under 100.00: 2",
+		"10,000.00 and over: 1",
+	} {
+		if !strings.Contains(output, expect) {
+			t.Errorf("Expected output to contain %q, but got:\n%s", expect, output)
 		}
-		json.NewEncoder(w).Encode(mockResponse)
+	}
+	if !strings.HasSuffix(output, "top donors: Dan  THB  20,000.00\n                        Amy  THB   1,500.00\n") {
+		t.Errorf("Expected the top 2 donors with Amy before Bob, got:\n%s", output)
+	}
+}
+
+func TestParseSizeBuckets(t *testing.T) {
+	cases := map[string][]int64{
+		"100,1000,10000": {100, 1000, 10000},
+		" 50 , 500 ":     {50, 500},
+		"1000,100":       nil,
+		"100,abc":        nil,
+		"0":              nil,
+	}
+
+	for spec, expected := range cases {
+		if got := parseSizeBuckets(spec); !reflect.DeepEqual(got, expected) {
+			t.Errorf("parseSizeBuckets(%q): expected %v, got %v", spec, expected, got)
+		}
+	}
+}
+
+func TestRunTotalOverflowRejectsRow(t *testing.T) {
+	var charges atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tokens" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_test_123456789"})
+			return
+		}
+		charges.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "charge", "id": "chrg_test_123456789"})
 	}))
-	defer mockChargeServer.Close()
+	defer server.Close()
 
-	failingTokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"object": "error", "message": "invalid card"}`))
+	client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+	recordCh := make(chan DonationRecord, 2)
+	recordCh <- DonationRecord{Line: 2, Name: "Whale", Amount: Amount{Subunits: math.MaxInt64 - 10, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Line: 3, Name: "Minnow", Amount: Amount{Subunits: 100, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	close(recordCh)
+
+	result := client.ProcessDonationsStream(recordCh)
+
+	if charges.Load() != 1 || result.Donations != 1 || result.Received.Subunits != math.MaxInt64-10 {
+		t.Errorf("Expected only the first donation to be charged, got %d charges and %+v", charges.Load(), result.Summary)
+	}
+	if len(result.Rejected) != 1 || result.Rejected[0].Line != 3 || !strings.Contains(result.Rejected[0].Reason, "overflow") {
+		t.Errorf("Expected the overflowing row to be rejected, got %+v", result.Rejected)
+	}
+
+	open := func(path string) (<-chan DonationRecord, error) {
+		ch := make(chan DonationRecord, 2)
+		ch <- DonationRecord{Line: 2, Name: "Whale", Amount: Amount{Subunits: math.MaxInt64 - 10, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+		ch <- DonationRecord{Line: 3, Name: "Minnow", Amount: Amount{Subunits: 100, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+		close(ch)
+		return ch, nil
+	}
+	p := client.Preview([]string{"donations.rot128"}, open)
+	if p.Donations != 1 || p.Total.Subunits != math.MaxInt64-10 {
+		t.Errorf("Expected the preview to total only the first donation, got %d donations of %s", p.Donations, p.Total)
+	}
+	if len(p.Rejected) != 1 || p.Rejected[0].Line != 3 || !strings.Contains(p.Rejected[0].Reason, "overflow") {
+		t.Errorf("Expected the preview to reject the overflowing row, got %+v", p.Rejected)
+	}
+}
+
+func TestSpendingLimits(t *testing.T) {
+	var charges atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tokens" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_test_123456789", "card": map[string]interface{}{"fingerprint": "fp_visa"}})
+			return
+		}
+		charges.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "charge", "id": "chrg_test_123456789"})
 	}))
-	defer failingTokenServer.Close()
+	defer server.Close()
 
 	cases := []struct {
-		name             string
-		records          []DonationRecord
-		check            []string
-		useFailingServer bool
+		name                                       string
+		minDonation, maxDonation, maxRun, maxDonor int
+		amounts                                    []int64
+		wantCharges                                int32
+		wantHeld                                   map[string]int
+		wantRetryable                              int
 	}{
+		{name: "omise minimum", minDonation: -1, amounts: []int64{1999, 2000}, wantCharges: 1, wantHeld: map[string]int{limitMinDonation: 1}},
+		{name: "no minimum", minDonation: 0, amounts: []int64{1, 2000}, wantCharges: 2},
+		{name: "configured minimum", minDonation: 50, amounts: []int64{4999, 5000}, wantCharges: 1, wantHeld: map[string]int{limitMinDonation: 1}},
+		{name: "maximum donation", minDonation: -1, maxDonation: 1000, amounts: []int64{100000, 100001}, wantCharges: 1, wantHeld: map[string]int{limitMaxDonation: 1}},
 		{
-			name: "single donor",
-			records: []DonationRecord{
-				{Name: "John Doe", AmountSubunits: "100000", CCNumber: "4242424242424242", CVV: "123", ExpMonth: "12", ExpYear: "2025"},
-			},
-			check: []string{"done.", "total received: THB", "successfully donated: THB", "faulty donation: THB", "average per person: THB", "top donors:", "John Doe"},
-		},
-		{
-			name:    "no donations",
-			records: []DonationRecord{},
-			check:   []string{"done.", "total received: THB", "successfully donated: THB", "faulty donation: THB", "average per person: THB", "top donors:"},
-		},
-		{
-			name: "multiple top donors",
-			records: []DonationRecord{
-				{Name: "Alice", AmountSubunits: "120000", CCNumber: "4242424242424242", CVV: "123", ExpMonth: "12", ExpYear: "2025"},
-				{Name: "Bob", AmountSubunits: "100000", CCNumber: "5555555555554444", CVV: "456", ExpMonth: "11", ExpYear: "2026"},
-				{Name: "Carol", AmountSubunits: "80000", CCNumber: "4111111111111111", CVV: "789", ExpMonth: "10", ExpYear: "2027"},
-				{Name: "Dave", AmountSubunits: "50000", CCNumber: "4000000000000002", CVV: "321", ExpMonth: "09", ExpYear: "2028"},
-			},
-			check: []string{"done.", "total received: THB", "successfully donated: THB", "faulty donation: THB", "average per person: THB", "top donors:", "Alice", "Bob", "Carol"},
-		},
-		{
-			name: "all successful",
-			records: []DonationRecord{
-				{Name: "Donor1", AmountSubunits: "100000", CCNumber: "4242424242424242", CVV: "123", ExpMonth: "12", ExpYear: "2025"},
-				{Name: "Donor2", AmountSubunits: "100000", CCNumber: "5555555555554444", CVV: "456", ExpMonth: "11", ExpYear: "2026"},
-			},
-			check: []string{"successfully donated: THB", "faulty donation: THB       0.00", "Donor1", "Donor2"},
-		},
-		{
-			name: "all failed",
-			records: []DonationRecord{
-				{Name: "Fail1", AmountSubunits: "100000", CCNumber: "0000000000000000", CVV: "000", ExpMonth: "01", ExpYear: "2000"},
-				{Name: "Fail2", AmountSubunits: "100000", CCNumber: "0000000000000000", CVV: "000", ExpMonth: "01", ExpYear: "2000"},
-			},
-			check:            []string{"successfully donated: THB       0.00", "faulty donation: THB   2,000.00", "top donors:"},
-			useFailingServer: true,
+			name: "run total stops scheduling", minDonation: -1, maxRun: 1000,
+			amounts: []int64{40000, 40000, 40000, 5000}, wantCharges: 2,
+			wantHeld: map[string]int{limitRunTotal: 2}, wantRetryable: 2,
 		},
+		{name: "donor total", minDonation: -1, maxDonor: 700, amounts: []int64{30000, 30000, 30000}, wantCharges: 2, wantHeld: map[string]int{limitDonorTotal: 1}},
 	}
-
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			var client *OmiseClient
-			if c.useFailingServer {
-				client = NewOmiseClientWithURLs(failingTokenServer.URL, mockChargeServer.URL)
-			} else {
-				client = NewOmiseClientWithURLs(mockTokenServer.URL, mockChargeServer.URL)
+			oldMin, oldMax, oldRun, oldDonor := minDonation, maxDonation, maxRunTotal, maxDonorTotal
+			minDonation, maxDonation, maxRunTotal, maxDonorTotal = c.minDonation, c.maxDonation, c.maxRun, c.maxDonor
+			defer func() { minDonation, maxDonation, maxRunTotal, maxDonorTotal = oldMin, oldMax, oldRun, oldDonor }()
+			charges.Store(0)
+
+			client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+			recordCh := make(chan DonationRecord, len(c.amounts))
+			for i, amount := range c.amounts {
+				recordCh <- DonationRecord{Line: i + 2, Name: "Jane Doe", Amount: Amount{Subunits: amount, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+			}
+			close(recordCh)
+
+			result := client.ProcessDonationsStream(recordCh)
+			if got := charges.Load(); got != c.wantCharges {
+				t.Errorf("Expected %d charges, got %d", c.wantCharges, got)
 			}
+			if !reflect.DeepEqual(result.HeldBack, c.wantHeld) {
+				t.Errorf("Expected held back %v, got %v", c.wantHeld, result.HeldBack)
+			}
+			if got := len(RetryableIDs(result)); got != c.wantRetryable {
+				t.Errorf("Expected %d retryable donations, got %d", c.wantRetryable, got)
+			}
+			for _, o := range result.Held() {
+				if o.Error == "" {
+					t.Errorf("Expected held donation %s to say why", o.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestUnconfirmedChargeKeepsReservation(t *testing.T) {
+	cases := []struct {
+		name             string
+		maxRun, maxDonor int
+		wantHeld         string
+	}{
+		{name: "run total", maxRun: 600, wantHeld: limitRunTotal},
+		{name: "donor total", maxDonor: 600, wantHeld: limitDonorTotal},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			oldRun, oldDonor := maxRunTotal, maxDonorTotal
+			maxRunTotal, maxDonorTotal = c.maxRun, c.maxDonor
+			defer func() { maxRunTotal, maxDonorTotal = oldRun, oldDonor }()
 
-			old := os.Stdout
-			r, w, _ := os.Pipe()
-			os.Stdout = w
+			// The second donation is only read once the first charge has
+			// failed, so that the test does not depend on how the stages
+			// interleave.
+			failed := make(chan struct{})
+			var charged atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				switch {
+				case r.URL.Path == "/tokens":
+					json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_" + r.FormValue("card[name]"), "card": map[string]interface{}{"fingerprint": "fp_visa"}})
+				case r.FormValue("card") == "tokn_First":
+					w.WriteHeader(http.StatusBadGateway)
+					w.Write([]byte(`{"object": "error", "code": "bad_gateway", "message": "upstream timed out"}`))
+				default:
+					charged.Add(1)
+					json.NewEncoder(w).Encode(map[string]interface{}{"object": "charge", "id": "chrg_test_123456789"})
+				}
+			}))
+			defer server.Close()
 
+			client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+			client.AddObserver(ObserverFunc(func(e Event) {
+				if e.Type == EventChargeFailed && e.Line == 2 {
+					close(failed)
+				}
+			}))
 			recordCh := make(chan DonationRecord)
 			go func() {
-				for _, r := range c.records {
-					recordCh <- r
-				}
+				recordCh <- DonationRecord{Line: 2, Name: "First", Amount: Amount{Subunits: 50000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+				<-failed
+				recordCh <- DonationRecord{Line: 3, Name: "Second", Amount: Amount{Subunits: 20000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
 				close(recordCh)
 			}()
 
-			client.ProcessDonationsStream(recordCh)
+			result := client.ProcessDonationsStream(recordCh)
+			if charged.Load() != 0 {
+				t.Errorf("Expected the unconfirmed charge to still count towards the cap, got %d charges", charged.Load())
+			}
+			if !reflect.DeepEqual(result.HeldBack, map[string]int{c.wantHeld: 1}) {
+				t.Errorf("Expected the second donation to be held by %s, got %v", c.wantHeld, result.HeldBack)
+			}
+		})
+	}
+}
+
+func TestPreview(t *testing.T) {
+	files := map[string][]DonationRecord{
+		"a.rot128": {
+			{Line: 2, Name: "Alice", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 12, Year: 2030}},
+			{Line: 3, Reject: &RowError{Line: 3, FieldCount: 2, Reason: "expected 6 fields"}},
+			{Line: 4, Name: "Expired", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2020}},
+		},
+		"b.rot128": {
+			{Line: 2, Name: "Bob", Amount: Amount{Subunits: 50000, Currency: "THB"}, Card: NewCard("5555555555554444", "456"), Expiry: Expiry{Month: 11, Year: 2031}},
+			{Line: 3, Name: "alice", Amount: Amount{Subunits: 20000, Currency: "THB"}, Card: NewCard("4111111111111111", "789"), Expiry: Expiry{Month: 10, Year: 2032}},
+			// Below Omise's THB 20 minimum, so the run would hold it back.
+			{Line: 4, Name: "Tiny", Amount: Amount{Subunits: 1000, Currency: "THB"}, Card: NewCard("4111111111111111", "789"), Expiry: Expiry{Month: 10, Year: 2032}},
+		},
+	}
+	open := func(path string) (<-chan DonationRecord, error) {
+		records, ok := files[path]
+		if !ok {
+			return nil, fmt.Errorf("open %s: no such file or directory", path)
+		}
+		ch := make(chan DonationRecord, len(records))
+		for _, r := range records {
+			ch <- r
+		}
+		close(ch)
+		return ch, nil
+	}
+
+	// Preview must not call Omise, so the client has nowhere to send requests.
+	client := NewOmiseClientWithURLs("", "")
+	p := client.Preview([]string{"a.rot128", "missing.rot128", "b.rot128"}, open)
 
-			w.Close()
-			os.Stdout = old
+	if p.Rows != 6 || p.Donations != 3 || p.Total.Subunits != 170000 {
+		t.Errorf("Expected 6 rows and 3 donations of 170000, got %d rows and %d donations of %d", p.Rows, p.Donations, p.Total.Subunits)
+	}
+	if p.Held != 1 || p.HeldAmount.Subunits != 1000 || p.HeldBack[limitMinDonation] != 1 {
+		t.Errorf("Expected the donation below the minimum to be held back, got %d of %d by %v", p.Held, p.HeldAmount.Subunits, p.HeldBack)
+	}
+	if len(p.Rejected) != 1 || p.Aborted != nil || p.PreRejected[card.ReasonExpired] != 1 {
+		t.Errorf("Unexpected rejections %+v and pre-rejections %v", p.Rejected, p.PreRejected)
+	}
+	if len(p.Files) != 3 || p.Files[1].Error == "" {
+		t.Errorf("Expected the missing file to be listed with its error, got %+v", p.Files)
+	}
+	if top := p.TopDonors(1); len(top) != 1 || top[0].Amount.Subunits != 120000 {
+		t.Errorf("Expected Alice's rows to be grouped by name, got %+v", p.Donors)
+	}
+	if top := p.TopDonors(-1); len(top) != 0 {
+		t.Errorf("Expected no top donors for a negative count, got %+v", top)
+	}
 
-			var buf bytes.Buffer
-			io.Copy(&buf, r)
+	var out bytes.Buffer
+	if err := RenderPreview(&out, p, "en"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, want := range []string{
+		"about to charge:",
+		"                  rows:              6\n",
+		"             donations:              3\n",
+		"          total amount: THB   1,700.00\n",
+		"line 3: expected 6 fields (2 fields)",
+		"missing.rot128: open missing.rot128: no such file or directory",
+		"expired_card: 1",
+		"             held back:              1\n" +
+			"                        below_minimum: 1\n" +
+			"      held back amount: THB      10.00\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected preview to contain %q, got:\n%s", want, out.String())
+		}
+	}
+
+	// In strict parse mode the malformed row would abort the run.
+	files["a.rot128"][1].Reject.Abort = true
+	if p := client.Preview([]string{"a.rot128"}, open); p.Aborted == nil || p.Aborted.Line != 3 {
+		t.Errorf("Expected the preview to report the aborting row, got %+v", p.Aborted)
+	}
+}
+
+func TestRenderHeldBack(t *testing.T) {
+	held := func(line int, reason string, subunits int64) DonationOutcome {
+		return DonationOutcome{ID: fmt.Sprintf(".:%d", line), Line: line, Name: "Jane Doe", Amount: Amount{Subunits: subunits, Currency: "THB"}, Outcome: OutcomeHeld, Reason: reason}
+	}
+	result := &RunResult{Mode: KeyModeTest, Currency: "THB", Summary: Summary{
+		Donations: 2,
+		Received:  Amount{Subunits: 501000, Currency: "THB"},
+		Faulty:    Amount{Subunits: 501000, Currency: "THB"},
+		HeldBack:  map[string]int{limitRunTotal: 1, limitMinDonation: 1},
+		Outcomes: []DonationOutcome{
+			held(2, limitRunTotal, 500000),
+			held(3, limitMinDonation, 1000),
+		},
+	}}
+
+	var out bytes.Buffer
+	if err := (TextRenderer{}).Render(&out, result); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, want := range []string{
+		"             held back:              2\n" +
+			"                        below_minimum: 1\n" +
+			"                        run_total_cap: 1\n",
+		"        held back rows:\n" +
+			"                        below_minimum: .:3 Jane Doe THB 10.00\n" +
+			"                        run_total_cap: .:2 Jane Doe THB 5,000.00\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected summary to contain:\n%s\ngot:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestObserverEvents(t *testing.T) {
+	var limited atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.URL.Path == "/tokens" && r.FormValue("card[name]") == "Retried" && limited.CompareAndSwap(false, true):
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"object": "error", "code": "too_many_requests", "message": "rate limit exceeded"}`))
+		case r.URL.Path == "/tokens":
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_" + r.FormValue("card[name]")})
+		case r.FormValue("card") == "tokn_Declined":
+			w.WriteHeader(http.StatusPaymentRequired)
+			w.Write([]byte(`{"object": "error", "code": "insufficient_fund", "message": "insufficient funds"}`))
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "charge", "id": "chrg_test_123456789"})
+		}
+	}))
+	defer server.Close()
+
+	oldWait := retryBaseWait
+	retryBaseWait = 10 * time.Millisecond
+	defer func() { retryBaseWait = oldWait }()
+
+	var mu sync.Mutex
+	byDonation := make(map[string][]EventType)
+	var limiterEvents []Event
+	client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+	client.AddObserver(ObserverFunc(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if e.Time.IsZero() {
+			t.Errorf("Expected %s event to be timestamped", e.Type)
+		}
+		if strings.Contains(e.Card, "4242424242424242") {
+			t.Errorf("Expected %s event to mask the card, got %s", e.Type, e.Card)
+		}
+		if e.DonationID == "" {
+			limiterEvents = append(limiterEvents, e)
+			return
+		}
+		byDonation[e.Name] = append(byDonation[e.Name], e.Type)
+		if e.Type == EventRetryScheduled && (e.Attempt != 1 || e.Wait != 10*time.Millisecond || e.Code != "rate_limit_exceeded") {
+			t.Errorf("Unexpected retry event %+v", e)
+		}
+	}))
+
+	recordCh := make(chan DonationRecord, 4)
+	recordCh <- DonationRecord{Source: "a.rot128", Line: 2, Name: "Paid", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Source: "a.rot128", Line: 3, Name: "Declined", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Source: "a.rot128", Line: 4, Name: "Expired", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2020}}
+	recordCh <- DonationRecord{Source: "a.rot128", Line: 5, Name: "Retried", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	close(recordCh)
+
+	client.ProcessDonationsStream(recordCh)
+
+	expected := map[string][]EventType{
+		"Paid":     {EventRowParsed, EventTokenCreated, EventChargeCreated},
+		"Declined": {EventRowParsed, EventTokenCreated, EventChargeFailed},
+		"Expired":  {EventRowParsed, EventChargeFailed},
+		"Retried":  {EventRowParsed, EventRetryScheduled, EventTokenCreated, EventChargeCreated},
+	}
+	if !reflect.DeepEqual(byDonation, expected) {
+		t.Errorf("Expected events %v, got %v", expected, byDonation)
+	}
+	if len(limiterEvents) != 2 || limiterEvents[0].Type != EventRateLimitPaused || limiterEvents[1].Type != EventRateLimitResumed ||
+		limiterEvents[1].Endpoint != metrics.EndpointToken || limiterEvents[1].Wait <= 0 {
+		t.Errorf("Expected a token pause followed by a resume, got %+v", limiterEvents)
+	}
+}
+
+type quarantineRow struct {
+	line      int
+	reason    string
+	retryable bool
+}
+
+type fakeQuarantine struct {
+	mu   sync.Mutex
+	rows []quarantineRow
+}
+
+func (q *fakeQuarantine) Add(record DonationRecord, reason string, retryable bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rows = append(q.rows, quarantineRow{record.Line, reason, retryable})
+}
+
+func TestQuarantineFailedRows(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.URL.Path == "/tokens" && r.FormValue("card[name]") == "Invalid":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"object": "error", "code": "invalid_card", "message": "invalid card"}`))
+		case r.URL.Path == "/tokens":
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_" + r.FormValue("card[name]")})
+		case r.FormValue("card") == "tokn_Broke":
+			w.WriteHeader(http.StatusPaymentRequired)
+			w.Write([]byte(`{"object": "error", "code": "insufficient_fund", "message": "insufficient funds"}`))
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "charge", "id": "chrg_test_123456789"})
+		}
+	}))
+	defer server.Close()
+
+	client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+	q := &fakeQuarantine{}
+	client.SetQuarantine(q)
+
+	recordCh := make(chan DonationRecord, 5)
+	recordCh <- DonationRecord{Line: 2, Name: "Paid", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Line: 3, Name: "Broke", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Line: 4, Name: "Invalid", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Line: 5, Name: "Expired", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2020}}
+	recordCh <- DonationRecord{Line: 6, Reject: &RowError{Line: 6, FieldCount: 2, Reason: "expected 6 fields"}}
+	close(recordCh)
+
+	result := client.ProcessDonationsStream(recordCh)
+
+	sort.Slice(q.rows, func(i, j int) bool { return q.rows[i].line < q.rows[j].line })
+	expected := []quarantineRow{
+		{3, "insufficient_fund", true},
+		{4, "invalid_card", false},
+		{5, "expired_card", false},
+		{6, "expected 6 fields", false},
+	}
+	if !reflect.DeepEqual(q.rows, expected) {
+		t.Errorf("Expected quarantined rows %+v, got %+v", expected, q.rows)
+	}
+	if failures := result.Failures(); len(failures) != 3 || !failures[0].Retryable || failures[1].Retryable {
+		t.Errorf("Expected only the soft decline to be retryable, got %+v", failures)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{nil, false},
+		{fmt.Errorf("rate limit: exceeded max retries"), true},
+		{fmt.Errorf("creating token: %w", &url.Error{Op: "Post", URL: "http://x", Err: io.EOF}), true},
+		{fmt.Errorf("creating token: %w", &APIError{StatusCode: 503}), true},
+		{fmt.Errorf("creating charge: %w", unconfirmedCharge(&APIError{StatusCode: 503})), false},
+		{fmt.Errorf("creating charge: %w", unconfirmedCharge(&url.Error{Op: "Post", URL: "http://x", Err: io.EOF})), false},
+		{fmt.Errorf("creating charge: %w", unconfirmedCharge(&APIError{StatusCode: 429})), true},
+		{fmt.Errorf("creating charge: %w", &APIError{StatusCode: 402, Code: "insufficient_fund"}), true},
+		{fmt.Errorf("creating charge: %w", &APIError{StatusCode: 402, Code: "failed_processing"}), true},
+		{fmt.Errorf("creating charge: %w", &APIError{StatusCode: 402, Code: "stolen_or_lost_card"}), false},
+		{fmt.Errorf("creating token: %w", &APIError{StatusCode: 400, Code: "invalid_card"}), false},
+	}
+
+	for _, c := range cases {
+		if got := IsRetryable(c.err); got != c.retryable {
+			t.Errorf("IsRetryable(%v): expected %v, got %v", c.err, c.retryable, got)
+		}
+	}
+}
+
+func TestRetryFailedDonations(t *testing.T) {
+	var declines atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.URL.Path == "/tokens":
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_" + r.FormValue("card[name]")})
+		case r.FormValue("card") == "tokn_Soft" && declines.Add(1) == 1:
+			w.WriteHeader(http.StatusPaymentRequired)
+			w.Write([]byte(`{"object": "error", "code": "insufficient_fund", "message": "insufficient funds"}`))
+		case r.FormValue("card") == "tokn_Hard":
+			w.WriteHeader(http.StatusPaymentRequired)
+			w.Write([]byte(`{"object": "error", "code": "stolen_or_lost_card", "message": "card was reported stolen"}`))
+		case r.FormValue("card") == "tokn_Lost":
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"object": "error", "code": "bad_gateway", "message": "upstream timed out"}`))
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "charge", "id": "chrg_test_123456789"})
+		}
+	}))
+	defer server.Close()
+
+	records := []DonationRecord{
+		{Line: 2, Name: "Paid", Amount: Amount{Subunits: 10000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}},
+		{Line: 3, Name: "Soft", Amount: Amount{Subunits: 20000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}},
+		{Line: 4, Name: "Hard", Amount: Amount{Subunits: 40000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}},
+		// A server error at the charge stage may come after the charge was made.
+		{Line: 5, Name: "Lost", Amount: Amount{Subunits: 80000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}},
+	}
+	open := func(path string) (<-chan DonationRecord, error) {
+		ch := make(chan DonationRecord)
+		go func() {
+			for _, r := range records {
+				r.Source = path
+				ch <- r
+			}
+			close(ch)
+		}()
+		return ch, nil
+	}
+
+	first, err := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges").ProcessDonationFiles([]string{"a.rot128"}, open)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	first.SetFileHashes(map[string]string{"a.rot128": "abc123"})
+	var report bytes.Buffer
+	if err := (JSONRenderer{}).Render(&report, first); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	previous, err := LoadRunResult(&report)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	ids := RetryableIDs(previous)
+	if !reflect.DeepEqual(ids, map[string]bool{"a.rot128:3": true}) {
+		t.Fatalf("Expected only the soft decline to be retryable, got %v", ids)
+	}
+	if lost := previous.Outcomes[3]; lost.Reason != errorCodeChargeUnconfirmed {
+		t.Errorf("Expected the lost charge to be unconfirmed, got %+v", lost)
+	}
+
+	retried, err := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges").ProcessDonationFiles([]string{"a.rot128"}, OnlyDonations(open, ids))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if retried.Donations != 1 || retried.Succeeded != 1 {
+		t.Fatalf("Expected the retry to charge only the soft decline, got %+v", retried.Summary)
+	}
+
+	merged := MergeRetry(previous, retried)
+	if merged.Donations != 4 || merged.Succeeded != 2 || merged.Donated.Subunits != 30000 || merged.Faulty.Subunits != 120000 {
+		t.Errorf("Unexpected merged totals %+v", merged.Summary)
+	}
+	if merged.Retried != 1 || merged.Recovered != 1 {
+		t.Errorf("Expected 1 retried and recovered donation, got %d and %d", merged.Retried, merged.Recovered)
+	}
+	soft := merged.Outcomes[1]
+	if soft.Outcome != OutcomeSucceeded || soft.Previous == nil || soft.Previous.Reason != errorCodeInsufficientFund {
+		t.Errorf("Expected the retried outcome to keep the original failure, got %+v", soft)
+	}
+	if len(merged.Files) != 1 || merged.Files[0].Succeeded != 2 || merged.Files[0].Retried != 1 || merged.Files[0].SHA256 != "abc123" {
+		t.Errorf("Unexpected merged per-file results %+v", merged.Files)
+	}
+
+	var buf bytes.Buffer
+	if err := (TextRenderer{}).Render(&buf, merged); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, expect := range []string{"retried:              1", "recovered on retry:              1"} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("Expected output to contain '%s', but got:\n%s", expect, buf.String())
+		}
+	}
+}
+
+func TestRetryInputs(t *testing.T) {
+	a := DonationRecord{Source: "jan/donations.rot128", Line: 2}
+	b := DonationRecord{Source: "feb/donations.rot128", Line: 2}
+	if a.ID() == b.ID() {
+		t.Errorf("Expected files with the same name in different directories to have different IDs, got %s", a.ID())
+	}
+
+	previous := &RunResult{Files: []FileResult{
+		{Path: "jan/donations.rot128", SHA256: "aaa"},
+		{Path: "feb/donations.rot128", SHA256: "bbb"},
+		{Path: "old.rot128"},
+	}}
+	cases := []struct {
+		name    string
+		hashes  map[string]string
+		wantErr string
+	}{
+		{"same files", map[string]string{"jan/donations.rot128": "aaa", "feb/donations.rot128": "bbb"}, ""},
+		{"one of the files", map[string]string{"feb/donations.rot128": "bbb"}, ""},
+		{"changed file", map[string]string{"jan/donations.rot128": "bbb"}, "has changed"},
+		{"other file", map[string]string{"mar/donations.rot128": "ccc"}, "not an input of the report"},
+		{"report without fingerprint", map[string]string{"old.rot128": "ddd"}, "no fingerprint"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := CheckRetryInputs(previous, c.hashes)
+			if c.wantErr == "" && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)) {
+				t.Errorf("Expected error containing %q, got %v", c.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTemplateRenderer(t *testing.T) {
+	thb := func(subunits int64) Amount { return Amount{Subunits: subunits, Currency: "THB"} }
+	result := &RunResult{Mode: KeyModeTest, Currency: "THB", Summary: summarize([]DonationOutcome{
+		{ID: "a:2", Name: "สมหญิง ใจดี", Amount: thb(150000), Outcome: OutcomeSucceeded},
+		{ID: "a:3", Name: "山田太郎", Amount: thb(120000), Outcome: OutcomeSucceeded},
+		{ID: "a:4", Name: "Luke", Amount: thb(9000), Outcome: OutcomeSucceeded},
+		{ID: "a:5", Name: "Leia", Amount: thb(5000), Outcome: OutcomeFailed, Reason: "insufficient_fund"},
+	}, nil, nil)}
+
+	r, err := NewTemplateRenderer("th", "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var buf bytes.Buffer
+	if err := r.Render(&buf, result); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	output := buf.String()
+
+	for _, expect := range []string{"เสร็จสิ้น", "ยอดรับทั้งหมด: THB   2,840.00", "insufficient_fund: 1", "อัตราความสำเร็จ:          75.0%"} {
+		if !strings.Contains(output, expect) {
+			t.Errorf("Expected output to contain %q, but got:\n%s", expect, output)
+		}
+	}
+
+	// Labels end, and donor amounts start, at the same display column on
+	// every line whatever script the text before them is in.
+	for _, line := range strings.Split(output, "\n") {
+		if i := strings.Index(line, ": "); i > 0 && !strings.HasPrefix(line, " ") && display.Width(line[:i]) != 22 {
+			t.Errorf("Expected the label to end at column 22, got %q", line)
+		}
+	}
+	lines := strings.Split(output, "\n")
+	top := slices.IndexFunc(lines, func(line string) bool { return strings.Contains(line, "ผู้บริจาคสูงสุด") })
+	for _, line := range lines[top : top+3] {
+		if got := display.Width(line[:strings.Index(line, "THB")]); got != 35 {
+			t.Errorf("Expected the donor amount at column 35, got %d in %q", got, line)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "summary.tmpl")
+	custom := `{{.UniqueDonors}} donors gave {{currency}} {{money .Donated}}{{range .TopDonors 1}}, led by {{.Name}}{{end}}`
+	if err := os.WriteFile(path, []byte(custom), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err = NewTemplateRenderer("de", path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	buf.Reset()
+	if err := r.Render(&buf, result); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := buf.String(); got != "3 donors gave THB 2.790,00, led by สมหญิง ใจดี" {
+		t.Errorf("Unexpected custom summary %q", got)
+	}
+}
+
+func TestNewRenderer(t *testing.T) {
+	for format, expected := range map[string]Renderer{"": TextRenderer{}, "text": TextRenderer{}, "JSON": JSONRenderer{}} {
+		r, err := NewRenderer(format, "en", "")
+		if err != nil || r != expected {
+			t.Errorf("NewRenderer(%q): expected %T, got %T, %v", format, expected, r, err)
+		}
+	}
+	if r, err := NewRenderer("text", "th", ""); err != nil {
+		t.Errorf("Expected the Thai template, got %v", err)
+	} else if _, ok := r.(*TemplateRenderer); !ok {
+		t.Errorf("Expected a *TemplateRenderer for Thai, got %T", r)
+	}
+
+	for _, args := range [][3]string{
+		{"xml", "en", ""},
+		{"text", "fr", ""},
+		{"json", "en", "summary.tmpl"},
+		{"text", "en", filepath.Join(t.TempDir(), "missing.tmpl")},
+	} {
+		if _, err := NewRenderer(args[0], args[1], args[2]); err == nil {
+			t.Errorf("NewRenderer(%q, %q, %q): expected an error", args[0], args[1], args[2])
+		}
+	}
+}
+
+func TestProcessDonationFiles(t *testing.T) {
+	mockTokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_test_123456789"})
+	}))
+	defer mockTokenServer.Close()
+
+	mockChargeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "charge", "id": "chrg_test_123456789"})
+	}))
+	defer mockChargeServer.Close()
+
+	files := map[string][]DonationRecord{
+		"a.rot128": {
+			{Name: "Alice", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 12, Year: 2030}},
+		},
+		"b.rot128": {
+			{Name: "Bob", Amount: Amount{Subunits: 50000, Currency: "THB"}, Card: NewCard("5555555555554444", "456"), Expiry: Expiry{Month: 11, Year: 2031}},
+			{Name: "Carol", Amount: Amount{Subunits: 20000, Currency: "THB"}, Card: NewCard("4111111111111111", "789"), Expiry: Expiry{Month: 10, Year: 2032}},
+		},
+	}
+	open := func(path string) (<-chan DonationRecord, error) {
+		records, ok := files[path]
+		if !ok {
+			return nil, fmt.Errorf("open %s: no such file or directory", path)
+		}
+		ch := make(chan DonationRecord)
+		go func() {
+			for _, r := range records {
+				r.Source = path
+				ch <- r
+			}
+			close(ch)
+		}()
+		return ch, nil
+	}
+
+	client := NewOmiseClientWithURLs(mockTokenServer.URL, mockChargeServer.URL)
+
+	result, err := client.ProcessDonationFiles([]string{"a.rot128", "missing.rot128", "b.rot128"}, open)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(result.Files) != 3 || result.Files[1].Error == "" || result.Files[2].Succeeded != 2 {
+		t.Errorf("Unexpected per-file results %+v", result.Files)
+	}
+	if result.Received.Subunits != 170000 || result.Donated.Subunits != 170000 || result.Succeeded != 3 {
+		t.Errorf("Unexpected totals %+v", result.Summary)
+	}
+
+	var buf bytes.Buffer
+	if err := (TextRenderer{}).Render(&buf, result); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	output := buf.String()
+
+	for _, expect := range []string{
+		"file: a.rot128",
+		"file: missing.rot128",
+		"error: open missing.rot128: no such file or directory",
+		"file: b.rot128",
+		"all files (2 processed, 1 failed):",
+		"total received: THB   1,700.00",
+		"Alice",
+		"Bob",
+		"Carol",
+	} {
+		if !strings.Contains(output, expect) {
+			t.Errorf("Expected output to contain '%s', but got:\n%s", expect, output)
+		}
+	}
+}
+
+func TestProcessDonationFilesRejectedRows(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_test_123456789"})
+	}))
+	defer mockServer.Close()
+
+	cases := []struct {
+		name    string
+		records []DonationRecord
+		check   []string
+		wantErr bool
+	}{
+		{
+			name: "lenient",
+			records: []DonationRecord{
+				{Line: 2, Reject: &RowError{Line: 2, FieldCount: 2, Reason: "expected 6 fields"}},
+				{Line: 3, Name: "Alice", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 12, Year: 2030}},
+			},
+			check: []string{"rejected rows:              1", "line 2: expected 6 fields (2 fields)", "Alice"},
+		},
+		{
+			name: "strict",
+			records: []DonationRecord{
+				{Line: 2, Reject: &RowError{Line: 2, FieldCount: 2, Reason: "expected 6 fields", Abort: true}},
+				{Line: 3, Name: "Alice", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 12, Year: 2030}},
+			},
+			check:   []string{"aborted: line 2: expected 6 fields (2 fields)", "total received: THB       0.00"},
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := NewOmiseClientWithURLs(mockServer.URL, mockServer.URL)
+			open := func(path string) (<-chan DonationRecord, error) {
+				ch := make(chan DonationRecord)
+				go func() {
+					for _, r := range c.records {
+						ch <- r
+					}
+					close(ch)
+				}()
+				return ch, nil
+			}
+
+			result, err := client.ProcessDonationFiles([]string{"donations.rot128"}, open)
+			if (err != nil) != c.wantErr {
+				t.Errorf("Expected error %v, got %v", c.wantErr, err)
+			}
+
+			var buf bytes.Buffer
+			(TextRenderer{}).Render(&buf, result)
+			output := buf.String()
+
+			for _, expect := range c.check {
+				if !strings.Contains(output, expect) {
+					t.Errorf("Expected output to contain '%s', but got:\n%s", expect, output)
+				}
+			}
+		})
+	}
+}
+
+func TestStrictAbortStopsTheRun(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_test_123456789"})
+	}))
+	defer mockServer.Close()
+
+	alice := DonationRecord{Line: 3, Name: "Alice", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 12, Year: 2030}}
+	abort := DonationRecord{Line: 2, Reject: &RowError{Line: 2, Reason: "expected 6 fields", Abort: true}}
+
+	// The good file only starts once the bad file's abort has been read, so
+	// that the test does not depend on how the two streams interleave.
+	badDone := make(chan struct{})
+	open := func(path string) (<-chan DonationRecord, error) {
+		ch := make(chan DonationRecord)
+		go func() {
+			defer close(ch)
+			switch path {
+			case "bad.rot128":
+				defer close(badDone)
+				ch <- abort
+				ch <- alice
+			case "good.rot128":
+				<-badDone
+				ch <- alice
+				ch <- alice
+			}
+		}()
+		return ch, nil
+	}
+
+	client := NewOmiseClientWithURLs(mockServer.URL, mockServer.URL)
+	result, err := client.ProcessDonationFiles([]string{"bad.rot128", "good.rot128"}, open)
+	if err == nil {
+		t.Error("Expected the aborted run to be reported")
+	}
+	if result.Donations != 0 {
+		t.Errorf("Expected no donations after the abort, got %+v", result.Files)
+	}
+
+	// The abort belongs to that run; the client must keep charging afterwards.
+	badDone = make(chan struct{})
+	close(badDone)
+	result, err = client.ProcessDonationFiles([]string{"good.rot128"}, open)
+	if err != nil || result.Succeeded != 2 {
+		t.Errorf("Expected the next run to charge 2 donations, got %d (%v)", result.Succeeded, err)
+	}
+}
+
+func TestPreRejectedDonationsSkipAPI(t *testing.T) {
+	var tokenRequests int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tokens" {
+			atomic.AddInt32(&tokenRequests, 1)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_test_123456789"})
+	}))
+	defer mockServer.Close()
+
+	client := NewOmiseClientWithURLs(mockServer.URL+"/tokens", mockServer.URL+"/charges")
+	s := newDonationStats()
+
+	recordCh := make(chan DonationRecord, 3)
+	recordCh <- DonationRecord{Name: "Expired", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2020}}
+	recordCh <- DonationRecord{Name: "Unknown", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("0000000000000000", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Name: "Valid", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	close(recordCh)
+
+	client.processStream(recordCh, s)
+
+	if tokenRequests != 1 {
+		t.Errorf("Expected only the valid card to reach the token endpoint, got %d requests", tokenRequests)
+	}
+	if s.preRejected[card.ReasonExpired] != 1 || s.preRejected[card.ReasonUnknownBrand] != 1 {
+		t.Errorf("Unexpected pre-rejections %v", s.preRejected)
+	}
+}
+
+func TestNewOmiseClientKeyModes(t *testing.T) {
+	cases := []struct {
+		name      string
+		pkey      string
+		skey      string
+		chargeURL string
+		live      bool
+		mode      KeyMode
+		wantErr   bool
+	}{
+		{name: "test keys", pkey: "pkey_test_123", skey: "skey_test_123", mode: KeyModeTest},
+		{name: "unrecognised keys", pkey: "test_public_key", skey: "test_secret_key", mode: KeyModeUnknown},
+		{name: "test keys with simulator", pkey: "pkey_test_123", skey: "skey_test_123", chargeURL: "http://localhost:8080/charges", mode: KeyModeTest},
+		{name: "live keys without --live", pkey: "pkey_live_123", skey: "skey_live_123", wantErr: true},
+		{name: "live keys with --live", pkey: "pkey_live_123", skey: "skey_live_123", live: true, mode: KeyModeLive},
+		{name: "live keys with simulator", pkey: "pkey_live_123", skey: "skey_live_123", chargeURL: "http://localhost:8080/charges", live: true, wantErr: true},
+		{name: "mixed keys", pkey: "pkey_test_123", skey: "skey_live_123", live: true, wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("OMISE_PKEY", c.pkey)
+			t.Setenv("OMISE_SKEY", c.skey)
+			t.Setenv("OMISE_CHARGE_URL", c.chargeURL)
+			liveModeEnabled = c.live
+			defer func() { liveModeEnabled = false }()
+
+			client, err := NewOmiseClient()
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("Expected error, got client in %s mode", client.KeyMode())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if client.KeyMode() != c.mode {
+				t.Errorf("Expected %s mode, got %s", c.mode, client.KeyMode())
+			}
+		})
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	var accountCurrencies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ := r.BasicAuth()
+		switch {
+		case r.URL.Path == "/tokens" || r.URL.Path == "/charges":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case user != "skey_test_123":
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"object": "error", "code": "authentication_failure", "message": "authentication failed"}`))
+		case r.URL.Path == "/account":
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "account", "supported_currencies": accountCurrencies})
+		case r.URL.Path == "/capability":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"object":          "capability",
+				"payment_methods": []map[string]interface{}{{"name": "card", "currencies": []string{"thb", "jpy"}}},
+			})
+		}
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		name       string
+		pkey       string
+		skey       string
+		currencies []string
+		failed     []string
+	}{
+		{name: "all good", pkey: "pkey_test_123", skey: "skey_test_123", currencies: []string{"THB", "JPY"}},
+		{name: "missing keys", failed: []string{"public key", "secret key", "account", "capability", "currency THB"}},
+		{name: "wrong secret key", pkey: "pkey_test_123", skey: "skey_test_999", failed: []string{"account", "capability", "currency THB"}},
+		{name: "malformed public key", pkey: "test_public_key", skey: "skey_test_123", currencies: []string{"THB"}, failed: []string{"public key"}},
+		{name: "unsupported currency", pkey: "pkey_test_123", skey: "skey_test_123", currencies: []string{"JPY"}, failed: []string{"currency THB"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("OMISE_PKEY", c.pkey)
+			t.Setenv("OMISE_SKEY", c.skey)
+			t.Setenv("OMISE_ACCOUNT_URL", server.URL+"/account")
+			t.Setenv("OMISE_CAPABILITY_URL", server.URL+"/capability")
+			t.Setenv("OMISE_TOKEN_URL", server.URL+"/tokens")
+			t.Setenv("OMISE_CHARGE_URL", server.URL+"/charges")
+			accountCurrencies = c.currencies
+
+			results := Preflight()
+
+			var failed []string
+			for _, r := range results {
+				if !r.OK() {
+					failed = append(failed, r.Name)
+				}
+			}
+			if strings.Join(failed, ",") != strings.Join(c.failed, ",") {
+				t.Errorf("Expected failed checks %v, got %v", c.failed, failed)
+			}
+			if (PreflightError(results) != nil) != (len(c.failed) > 0) {
+				t.Errorf("Unexpected PreflightError %v", PreflightError(results))
+			}
+		})
+	}
+
+	t.Run("unreachable endpoints", func(t *testing.T) {
+		t.Setenv("OMISE_TOKEN_URL", "http://127.0.0.1:1/tokens")
+		t.Setenv("OMISE_CHARGE_URL", "http://127.0.0.1:1/charges")
+
+		for _, r := range Preflight() {
+			if (r.Name == "token endpoint" || r.Name == "charge endpoint") && r.OK() {
+				t.Errorf("Expected %s to be unreachable", r.Name)
+			}
+		}
+	})
+}
+
+func TestLogsNeverContainCardData(t *testing.T) {
+	var logBuf bytes.Buffer
+	oldLogger := slog.Default()
+	slog.SetDefault(logging.New(&logBuf, "debug", "json"))
+	defer slog.SetDefault(oldLogger)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object":  "error",
+			"message": fmt.Sprintf("card %s with security code %s rejected for skey_test_abc", r.FormValue("card[number]"), r.FormValue("card[security_code]")),
+		})
+	}))
+	defer server.Close()
+
+	client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+
+	recordCh := make(chan DonationRecord, 3)
+	recordCh <- DonationRecord{Source: "a.rot128", Line: 2, Name: "John Doe", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Source: "a.rot128", Line: 3, Name: "Expired", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("5555555555554444", "456"), Expiry: Expiry{Month: 1, Year: 2020}}
+	recordCh <- DonationRecord{Source: "a.rot128", Line: 4, Reject: &RowError{Line: 4, FieldCount: 2, Reason: "expected 6 fields"}}
+	close(recordCh)
+
+	client.processStream(recordCh, newDonationStats())
+
+	out := logBuf.String()
+	if regexp.MustCompile(`\d(?:[ -]?\d){11,18}`).MatchString(out) {
+		t.Errorf("Expected no card numbers in logs, got %s", out)
+	}
+	for _, secret := range []string{"security code 123", "skey_test_abc"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("Expected %q to be redacted, got %s", secret, out)
+		}
+	}
+	for _, field := range []string{`"row":2`, `"donation_id":"a.rot128:2"`, `"donation_id":"a.rot128:3"`, `"row":4`} {
+		if !strings.Contains(out, field) {
+			t.Errorf("Expected logs to contain %s, got %s", field, out)
+		}
+	}
+}
+
+func TestProcessDonationsMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.URL.Path == "/tokens":
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_" + r.FormValue("card[name]")})
+		case r.FormValue("card") == "tokn_Declined":
+			w.WriteHeader(http.StatusPaymentRequired)
+			w.Write([]byte(`{"object": "error", "code": "insufficient_fund", "message": "insufficient funds"}`))
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "charge", "id": "chrg_test_123456789"})
+		}
+	}))
+	defer server.Close()
+
+	tokens := testutil.ToFloat64(metrics.TokensCreated)
+	succeeded := testutil.ToFloat64(metrics.ChargesSucceeded)
+	declined := testutil.ToFloat64(metrics.ChargesFailed.WithLabelValues("insufficient_fund"))
+	expired := testutil.ToFloat64(metrics.RowsRejected.WithLabelValues(string(card.ReasonExpired)))
+
+	client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+
+	recordCh := make(chan DonationRecord, 3)
+	recordCh <- DonationRecord{Name: "Paid", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Name: "Declined", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	recordCh <- DonationRecord{Name: "Expired", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2020}}
+	close(recordCh)
+
+	client.processStream(recordCh, newDonationStats())
+
+	if got := testutil.ToFloat64(metrics.TokensCreated) - tokens; got != 2 {
+		t.Errorf("Expected 2 tokens created, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.ChargesSucceeded) - succeeded; got != 1 {
+		t.Errorf("Expected 1 charge succeeded, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.ChargesFailed.WithLabelValues("insufficient_fund")) - declined; got != 1 {
+		t.Errorf("Expected 1 insufficient_fund failure, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.RowsRejected.WithLabelValues(string(card.ReasonExpired))) - expired; got != 1 {
+		t.Errorf("Expected 1 expired rejection, got %v", got)
+	}
+	if testutil.CollectAndCount(metrics.RequestDuration) == 0 {
+		t.Errorf("Expected request latencies to be recorded")
+	}
+	for _, endpoint := range []string{metrics.EndpointToken, metrics.EndpointCharge} {
+		if got := testutil.ToFloat64(metrics.WorkersInFlight.WithLabelValues(endpoint)); got != 0 {
+			t.Errorf("Expected no %s workers in flight after processing, got %v", endpoint, got)
+		}
+	}
+}
+
+func TestRateLimiterStats(t *testing.T) {
+	rl := NewRateLimiter()
+	rl.Pause()
+	rl.Pause()
+	time.Sleep(10 * time.Millisecond)
+	rl.Resume()
+	rl.WaitIfPaused()
+
+	pauses, paused := rl.Stats()
+	if pauses != 1 {
+		t.Errorf("Expected 1 pause, got %d", pauses)
+	}
+	if paused < 10*time.Millisecond {
+		t.Errorf("Expected at least 10ms paused, got %v", paused)
+	}
+}
+
+func TestStageLimiterSpacing(t *testing.T) {
+	rl := newStageLimiter(100, nil, nil)
+	start := time.Now()
+	for range 5 {
+		rl.Wait()
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected 5 requests at 100 rps to take at least 40ms, took %v", elapsed)
+	}
+
+	unlimited := newStageLimiter(0, nil, nil)
+	start = time.Now()
+	for range 100 {
+		unlimited.Wait()
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("Expected an unlimited stage not to wait, took %v", elapsed)
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	l := NewConcurrencyLimiter(metrics.EndpointCharge, 2, 1, 4)
+	healthy := func(n int, latency time.Duration) {
+		for range n {
+			l.Observe(latency, nil)
+		}
+	}
+
+	healthy(2, 10*time.Millisecond)
+	if got := l.Limit(); got != 3 {
+		t.Errorf("Expected the limit to grow to 3 after 2 healthy responses, got %d", got)
+	}
+	healthy(3+4+4, 10*time.Millisecond)
+	if got := l.Limit(); got != 4 {
+		t.Errorf("Expected the limit to stop at the upper bound of 4, got %d", got)
+	}
+
+	l.Observe(time.Millisecond, &APIError{StatusCode: 429})
+	l.Observe(time.Millisecond, &APIError{StatusCode: 429})
+	if got := l.Limit(); got != 2 {
+		t.Errorf("Expected one burst of 429s to halve the limit once, got %d", got)
+	}
+
+	l.Observe(time.Millisecond, &APIError{StatusCode: 402, Code: "insufficient_fund"})
+	if got := l.Limit(); got != 2 {
+		t.Errorf("Expected a declined card not to change the limit, got %d", got)
+	}
+
+	healthy(4, 10*time.Millisecond)
+	healthy(1, 100*time.Millisecond)
+	if got := l.Limit(); got != 1 {
+		t.Errorf("Expected rising latency to back off to the lower bound, got %d", got)
+	}
+	if got := l.Peak(); got != 4 {
+		t.Errorf("Expected a peak of 4, got %d", got)
+	}
+	if got := testutil.ToFloat64(metrics.ConcurrencyLimit.WithLabelValues(metrics.EndpointCharge)); got != 1 {
+		t.Errorf("Expected the concurrency gauge to follow the limit, got %v", got)
+	}
+
+	fixed := NewConcurrencyLimiter(metrics.EndpointToken, 3, 3, 3)
+	fixed.Observe(time.Millisecond, &APIError{StatusCode: 429})
+	for range 10 {
+		fixed.Observe(time.Millisecond, nil)
+	}
+	if got := fixed.Limit(); got != 3 {
+		t.Errorf("Expected a fixed limiter to stay at 3, got %d", got)
+	}
+}
+
+func TestAdaptiveConcurrencyBacksOffOnRateLimit(t *testing.T) {
+	oldMode, oldMin, oldMax := concurrencyMode, minWorkers, maxWorkers
+	concurrencyMode, minWorkers, maxWorkers = concurrencyModeAdaptive, 1, 8
+	defer func() { concurrencyMode, minWorkers, maxWorkers = oldMode, oldMin, oldMax }()
+
+	client := NewOmiseClientWithURLs("https://vault.omise.co/tokens", "https://api.omise.co/charges")
+	client.tokenLimiter.Pause()
+	client.tokenLimiter.Resume()
+
+	if got := client.tokenConcurrency.Limit(); got != 2 {
+		t.Errorf("Expected a rate limiter pause to halve the token stage from 4 to 2, got %d", got)
+	}
+	if got := client.chargeConcurrency.Limit(); got != 4 {
+		t.Errorf("Expected the charge stage to keep 4 workers, got %d", got)
+	}
+}
+
+func TestSlowChargesDoNotHoldUpTokenization(t *testing.T) {
+	release := make(chan struct{})
+	var tokenCount atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tokens" {
+			tokenCount.Add(1)
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_test_123456789"})
+			return
+		}
+		<-release
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "charge", "id": "chrg_test_123456789"})
+	}))
+	defer server.Close()
+
+	oldWorkers, oldQueue := chargeWorkers, chargeQueueSize
+	chargeWorkers, chargeQueueSize = 1, 8
+	defer func() { chargeWorkers, chargeQueueSize = oldWorkers, oldQueue }()
+
+	client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+	recordCh := make(chan DonationRecord, 6)
+	for i := range 6 {
+		recordCh <- DonationRecord{Line: i + 2, Name: "John Doe", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	}
+	close(recordCh)
+
+	s := newDonationStats()
+	done := make(chan struct{})
+	go func() {
+		client.processStream(recordCh, s)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for tokenCount.Load() < 6 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := tokenCount.Load(); got != 6 {
+		t.Errorf("Expected all 6 donations to be tokenized while the charge endpoint is blocked, got %d", got)
+	}
+
+	close(release)
+	<-done
+	if s.successCount != 6 {
+		t.Errorf("Expected 6 successful donations, got %d", s.successCount)
+	}
+}
+
+// BenchmarkPipeline compares the staged pipeline against the previous design
+// of tokenizing and charging serially inside one bounded pool, with the API
+// host answering slower than the vault.
+func BenchmarkPipeline(b *testing.B) {
+	const tokenLatency, chargeLatency = 2 * time.Millisecond, 10 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tokens" {
+			time.Sleep(tokenLatency)
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_test_123456789"})
+			return
+		}
+		time.Sleep(chargeLatency)
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "charge", "id": "chrg_test_123456789"})
+	}))
+	defer server.Close()
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	record := DonationRecord{Name: "John Doe", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}}
+	records := func(n int) <-chan DonationRecord {
+		ch := make(chan DonationRecord, n)
+		for range n {
+			ch <- record
+		}
+		close(ch)
+		return ch
+	}
+	report := func(b *testing.B, start time.Time) {
+		b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "donations/s")
+	}
+
+	b.Run("serial", func(b *testing.B) {
+		client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+		ctx := context.Background()
+		rl := NewRateLimiter()
+		workers := make(chan struct{}, defaultMaxDonationGoroutines)
+		var wg sync.WaitGroup
+		start := time.Now()
+		for range b.N {
+			wg.Add(1)
+			workers <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-workers }()
+				token, err := client.tokenService.CreateTokenWithRateLimit(ctx, record.Name, record.Card.Number(), record.Card.CVV(), "1", "2030", rl, nil)
+				if err == nil {
+					client.chargeService.CreateChargeWithRateLimit(ctx, "100000", token.ID, "charge", rl, nil)
+				}
+			}()
+		}
+		wg.Wait()
+		report(b, start)
+	})
+
+	for _, stages := range []struct {
+		name                  string
+		tokenPool, chargePool int
+	}{
+		{"staged-4-4", 4, 4},
+		{"staged-2-8", 2, 8},
+	} {
+		b.Run(stages.name, func(b *testing.B) {
+			oldToken, oldCharge := tokenWorkers, chargeWorkers
+			tokenWorkers, chargeWorkers = stages.tokenPool, stages.chargePool
+			defer func() { tokenWorkers, chargeWorkers = oldToken, oldCharge }()
+
+			client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+			start := time.Now()
+			client.processStream(records(b.N), newDonationStats())
+			report(b, start)
+		})
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		code string
+	}{
+		{fmt.Errorf("creating charge: %w", &APIError{StatusCode: 402, Code: "insufficient_fund"}), "insufficient_fund"},
+		{fmt.Errorf("creating token: %w", &APIError{StatusCode: 429}), "rate_limit_exceeded"},
+		{fmt.Errorf("rate limit: exceeded max retries"), "rate_limit_exceeded"},
+		{fmt.Errorf("creating token: %w", &url.Error{Op: "Post", URL: "http://x", Err: io.EOF}), "network_error"},
+		{fmt.Errorf("creating token: %w", &APIError{StatusCode: 500}), "unknown"},
+	}
+
+	for _, c := range cases {
+		if got := errorCode(c.err); got != c.code {
+			t.Errorf("errorCode(%v): expected %s, got %s", c.err, c.code, got)
+		}
+	}
+}
+
+func TestDonationTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	oldProvider, oldPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(oldProvider)
+		otel.SetTextMapPropagator(oldPropagator)
+	}()
+
+	var traceparents []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		mu.Unlock()
+		if r.URL.Path == "/tokens" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"object": "token", "id": "tokn_test_123456789"})
+			return
+		}
+		w.WriteHeader(http.StatusPaymentRequired)
+		w.Write([]byte(`{"object": "error", "code": "invalid_card", "message": "card 4242424242424242 declined"}`))
+	}))
+	defer server.Close()
+
+	client := NewOmiseClientWithURLs(server.URL+"/tokens", server.URL+"/charges")
+	parsed := time.Now().Add(-time.Millisecond)
+	record := DonationRecord{
+		Source: "a.rot128", Line: 2, Name: "John Doe",
+		Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030},
+		ParseStarted: parsed, ParseFinished: parsed.Add(100 * time.Microsecond),
+	}
+
+	recordCh := make(chan DonationRecord, 1)
+	recordCh <- record
+	close(recordCh)
+	s := newDonationStats()
+	client.processStream(recordCh, s)
+	if s.successCount != 0 {
+		t.Fatal("Expected the charge to fail")
+	}
+
+	spans := recorder.Ended()
+	byName := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, span := range spans {
+		byName[span.Name()] = append(byName[span.Name()], span)
+	}
+
+	if len(byName["donation"]) != 1 {
+		t.Fatalf("Expected one donation span, got %d spans", len(spans))
+	}
+	root := byName["donation"][0]
+	if !root.StartTime().Equal(parsed) {
+		t.Errorf("Expected donation span to start when parsing started")
+	}
+	if root.Status().Code != codes.Error || strings.Contains(root.Status().Description, "4242424242424242") {
+		t.Errorf("Expected a redacted error status, got %+v", root.Status())
+	}
+
+	for name, count := range map[string]int{"parse": 1, "wait_for_limiter": 2, "token_request": 1, "charge_request": 1} {
+		if len(byName[name]) != count {
+			t.Errorf("Expected %d %s spans, got %d", count, name, len(byName[name]))
+		}
+		for _, span := range byName[name] {
+			if span.Parent().SpanID() != root.SpanContext().SpanID() {
+				t.Errorf("Expected %s to be a child of the donation span", name)
+			}
+		}
+	}
+
+	if len(traceparents) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(traceparents))
+	}
+	for _, tp := range traceparents {
+		if !strings.Contains(tp, root.SpanContext().TraceID().String()) {
+			t.Errorf("Expected traceparent header for trace %s, got %q", root.SpanContext().TraceID(), tp)
+		}
+	}
+}
+
+func TestCardFormatting(t *testing.T) {
+	record := DonationRecord{
+		Name: "John Doe",
+		Card: NewCard("4242424242424242", "123"),
+		Row:  NewRawRow([]string{"John Doe", "5000", "4242424242424242", "123", "12", "2030"}),
+	}
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q"} {
+		out := fmt.Sprintf(format, record)
+		if strings.Contains(out, "4242424242424242") || strings.Contains(out, "123}") || strings.Contains(out, " 123 ") {
+			t.Errorf("Expected %s to mask card data, got %s", format, out)
+		}
+		if !strings.Contains(out, "****4242") {
+			t.Errorf("Expected %s to show masked number, got %s", format, out)
+		}
+	}
+
+	text, _ := record.Card.MarshalText()
+	if string(text) != "****4242" {
+		t.Errorf("Expected masked text, got %s", text)
+	}
+	if row := fmt.Sprintf("%+v", record.Row); row != "[6 fields]" {
+		t.Errorf("Expected the raw row to format as its field count, got %s", row)
+	}
+}
+
+func TestParseAmountAndExpiry(t *testing.T) {
+	amount, err := ParseAmount(" 5000 ")
+	if err != nil || amount != (Amount{Subunits: 5000, Currency: "THB"}) {
+		t.Errorf("Expected 5000 THB, got %+v, %v", amount, err)
+	}
+	for _, bad := range []string{"", "abc", "0", "-1", "10.5"} {
+		if _, err := ParseAmount(bad); err == nil {
+			t.Errorf("Expected error for amount %q", bad)
+		}
+	}
+
+	expiry, err := ParseExpiry("06", "2026")
+	if err != nil || expiry != (Expiry{Month: 6, Year: 2026}) {
+		t.Errorf("Expected 06/2026, got %+v, %v", expiry, err)
+	}
+	for _, bad := range [][2]string{{"0", "2026"}, {"13", "2026"}, {"1", "26"}, {"x", "2026"}, {"1", "y"}} {
+		if _, err := ParseExpiry(bad[0], bad[1]); err == nil {
+			t.Errorf("Expected error for expiry %v", bad)
+		}
+	}
+}
+
+func (c *OmiseClient) CreateToken(name, ccNumber, cvv, expMonth, expYear string) (Token, error) {
+	return c.tokenService.CreateToken(context.Background(), name, ccNumber, cvv, expMonth, expYear)
+}
+
+func (c *OmiseClient) CreateCharge(amount string, tokenID, description string) (string, error) {
+	return c.chargeService.CreateCharge(context.Background(), amount, tokenID, description)
+}
+
+func NewOmiseClientWithURLs(tokenURL, chargeURL string) *OmiseClient {
+	oldTokenURL := os.Getenv("OMISE_TOKEN_URL")
+	oldChargeURL := os.Getenv("OMISE_CHARGE_URL")
+
+	os.Setenv("OMISE_TOKEN_URL", tokenURL)
+	os.Setenv("OMISE_CHARGE_URL", chargeURL)
+
+	client, err := NewOmiseClient()
+	if err != nil {
+		panic(err)
+	}
+
+	os.Setenv("OMISE_TOKEN_URL", oldTokenURL)
+	os.Setenv("OMISE_CHARGE_URL", oldChargeURL)
+
+	return client
+}
+
+func init() {
+	os.Setenv("OMISE_PKEY", "test_public_key")
+	os.Setenv("OMISE_SKEY", "test_secret_key")
+}
+
+func TestRenderText(t *testing.T) {
+	mockTokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mockResponse := map[string]interface{}{
+			"object": "token",
+			"id":     "tokn_test_123456789",
+		}
+		json.NewEncoder(w).Encode(mockResponse)
+	}))
+	defer mockTokenServer.Close()
+
+	mockChargeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mockResponse := map[string]interface{}{
+			"object": "charge",
+			"id":     "chrg_test_123456789",
+		}
+		json.NewEncoder(w).Encode(mockResponse)
+	}))
+	defer mockChargeServer.Close()
+
+	failingTokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"object": "error", "message": "invalid card"}`))
+	}))
+	defer failingTokenServer.Close()
+
+	cases := []struct {
+		name             string
+		records          []DonationRecord
+		check            []string
+		useFailingServer bool
+	}{
+		{
+			name: "single donor",
+			records: []DonationRecord{
+				{Name: "John Doe", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 12, Year: 2030}},
+			},
+			check: []string{"done.", "mode: UNKNOWN", "token workers: 4 (peak 4, bounds 4-4)", "charge workers: 4 (peak 4, bounds 4-4)", "total received: THB", "successfully donated: THB", "faulty donation: THB", "average per person: THB", "top donors:", "John Doe"},
+		},
+		{
+			name:    "no donations",
+			records: []DonationRecord{},
+			check:   []string{"done.", "total received: THB", "successfully donated: THB", "faulty donation: THB", "average per person: THB", "top donors:"},
+		},
+		{
+			name: "multiple top donors",
+			records: []DonationRecord{
+				{Name: "Alice", Amount: Amount{Subunits: 120000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 12, Year: 2030}},
+				{Name: "Bob", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("5555555555554444", "456"), Expiry: Expiry{Month: 11, Year: 2031}},
+				{Name: "Carol", Amount: Amount{Subunits: 80000, Currency: "THB"}, Card: NewCard("4111111111111111", "789"), Expiry: Expiry{Month: 10, Year: 2032}},
+				{Name: "Dave", Amount: Amount{Subunits: 50000, Currency: "THB"}, Card: NewCard("4000000000000002", "321"), Expiry: Expiry{Month: 9, Year: 2033}},
+			},
+			check: []string{"done.", "total received: THB", "successfully donated: THB", "faulty donation: THB", "average per person: THB", "top donors:", "Alice", "Bob", "Carol"},
+		},
+		{
+			name: "all successful",
+			records: []DonationRecord{
+				{Name: "Donor1", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 12, Year: 2030}},
+				{Name: "Donor2", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("5555555555554444", "456"), Expiry: Expiry{Month: 11, Year: 2031}},
+			},
+			check: []string{"successfully donated: THB", "faulty donation: THB       0.00", "Donor1", "Donor2"},
+		},
+		{
+			name: "pre-rejected before tokenization",
+			records: []DonationRecord{
+				{Name: "Expired", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2020}},
+				{Name: "BadLuhn", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424241", "123"), Expiry: Expiry{Month: 1, Year: 2030}},
+				{Name: "Valid", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("4242424242424242", "123"), Expiry: Expiry{Month: 1, Year: 2030}},
+			},
+			check:            []string{"successfully donated: THB       0.00", "pre-rejected cards:              2", "expired_card: 1", "invalid_checksum: 1"},
+			useFailingServer: true,
+		},
+		{
+			name: "all failed",
+			records: []DonationRecord{
+				{Name: "Fail1", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("0000000000000000", "000"), Expiry: Expiry{Month: 1, Year: 2000}},
+				{Name: "Fail2", Amount: Amount{Subunits: 100000, Currency: "THB"}, Card: NewCard("0000000000000000", "000"), Expiry: Expiry{Month: 1, Year: 2000}},
+			},
+			check:            []string{"successfully donated: THB       0.00", "faulty donation: THB   2,000.00", "pre-rejected cards:              2", "unknown_brand: 2", "top donors:"},
+			useFailingServer: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var client *OmiseClient
+			if c.useFailingServer {
+				client = NewOmiseClientWithURLs(failingTokenServer.URL, mockChargeServer.URL)
+			} else {
+				client = NewOmiseClientWithURLs(mockTokenServer.URL, mockChargeServer.URL)
+			}
+
+			recordCh := make(chan DonationRecord)
+			go func() {
+				for _, r := range c.records {
+					recordCh <- r
+				}
+				close(recordCh)
+			}()
+
+			var buf bytes.Buffer
+			if err := (TextRenderer{}).Render(&buf, client.ProcessDonationsStream(recordCh)); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
 			output := buf.String()
 
 			for _, expect := range c.check {
@@ -0,0 +1,231 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-tamboon/metrics"
+	"go-tamboon/tracing"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// donationJob carries one donation from the tokenize stage to the charge
+// stage together with the span that covers both.
+type donationJob struct {
+	record   DonationRecord
+	stats    *donationStats
+	ctx      context.Context
+	span     trace.Span
+	token    Token
+	chargeID string
+
+	// duplicateOf is the ID of an earlier donation with the same card,
+	// amount and name.
+	duplicateOf string
+
+	// reservedRun and reservedDonor are set while the donation's amount
+	// counts towards the run and donor caps.
+	reservedRun   bool
+	reservedDonor bool
+}
+
+// pipeline tokenizes and charges donations in two stages, each with its own
+// concurrency limit, bounded queue and rate limiter, so a slow API host does not
+// hold up the vault and the other way round.
+type pipeline struct {
+	tokens     chan *donationJob
+	charges    chan *donationJob
+	tokenWG    sync.WaitGroup
+	chargeWG   sync.WaitGroup
+	duplicates *duplicateRows
+	limits     *spendingLimits
+
+	// aborted is set once a row in strict parse mode aborts the run.
+	aborted atomic.Bool
+}
+
+func (c *OmiseClient) startPipeline() *pipeline {
+	p := &pipeline{
+		tokens:     make(chan *donationJob, max(tokenQueueSize, 0)),
+		charges:    make(chan *donationJob, max(chargeQueueSize, 0)),
+		duplicates: newDuplicateRows(),
+		limits:     newSpendingLimits(),
+	}
+	for range c.tokenConcurrency.max {
+		p.tokenWG.Add(1)
+		go c.tokenWorker(p)
+	}
+	for range c.chargeConcurrency.max {
+		p.chargeWG.Add(1)
+		go c.chargeWorker(p)
+	}
+	return p
+}
+
+// close stops accepting donations and returns once every queued donation
+// has been charged or has failed.
+func (p *pipeline) close() {
+	close(p.tokens)
+	p.tokenWG.Wait()
+	close(p.charges)
+	p.chargeWG.Wait()
+}
+
+func (c *OmiseClient) tokenWorker(p *pipeline) {
+	defer p.tokenWG.Done()
+	for {
+		c.tokenConcurrency.Acquire()
+		job, ok := <-p.tokens
+		if !ok {
+			c.tokenConcurrency.Release()
+			return
+		}
+
+		inFlight := metrics.WorkersInFlight.WithLabelValues(metrics.EndpointToken)
+		inFlight.Inc()
+		start := time.Now()
+		err := c.tokenize(job)
+		c.tokenConcurrency.Observe(time.Since(start), err)
+		inFlight.Dec()
+		c.tokenConcurrency.Release()
+
+		if err != nil {
+			p.limits.release(job)
+			c.finish(job, metrics.EndpointToken, err)
+			continue
+		}
+		if c.skipDuplicate(p, job) {
+			p.limits.release(job)
+			continue
+		}
+		if limitErr := p.limits.admitDonor(job); limitErr != nil {
+			p.duplicates.release(job)
+			p.limits.release(job)
+			endSpan(job.span, nil)
+			c.hold(job, limitErr)
+			continue
+		}
+		p.charges <- job
+	}
+}
+
+func (c *OmiseClient) chargeWorker(p *pipeline) {
+	defer p.chargeWG.Done()
+	for {
+		c.chargeConcurrency.Acquire()
+		job, ok := <-p.charges
+		if !ok {
+			c.chargeConcurrency.Release()
+			return
+		}
+
+		inFlight := metrics.WorkersInFlight.WithLabelValues(metrics.EndpointCharge)
+		inFlight.Inc()
+		start := time.Now()
+		err := c.charge(job)
+		c.chargeConcurrency.Observe(time.Since(start), err)
+		inFlight.Dec()
+		c.chargeConcurrency.Release()
+
+		if err != nil {
+			// An unconfirmed charge may have been made, so its row stays
+			// claimed and its amount still counts towards the caps.
+			var unconfirmed *UnconfirmedChargeError
+			if !errors.As(err, &unconfirmed) {
+				p.duplicates.release(job)
+				p.limits.release(job)
+			}
+		}
+		c.finish(job, metrics.EndpointCharge, err)
+	}
+}
+
+func (c *OmiseClient) tokenize(job *donationJob) error {
+	record := job.record
+	tracer := tracing.Tracer()
+	spanOpts := []trace.SpanStartOption{trace.WithAttributes(
+		attribute.Int("row", record.Line),
+		attribute.String("donation_id", record.ID()),
+		attribute.Int64("amount", record.Amount.Subunits),
+		attribute.String("currency", record.Amount.Currency),
+	)}
+	if !record.ParseStarted.IsZero() {
+		spanOpts = append(spanOpts, trace.WithTimestamp(record.ParseStarted))
+	}
+	job.ctx, job.span = tracer.Start(context.Background(), tracing.SpanDonation, spanOpts...)
+
+	if !record.ParseStarted.IsZero() {
+		_, parseSpan := tracer.Start(job.ctx, tracing.SpanParse, trace.WithTimestamp(record.ParseStarted))
+		parseSpan.End(trace.WithTimestamp(record.ParseFinished))
+	}
+
+	slog.Debug("tokenizing donation", "row", record.Line, "donation_id", record.ID())
+	waitForLimiter(job.ctx, c.tokenLimiter)
+	tokenCtx, tokenSpan := tracer.Start(job.ctx, tracing.SpanTokenRequest)
+	token, err := c.tokenService.CreateTokenWithRateLimit(tokenCtx,
+		record.Name, record.Card.Number(), record.Card.CVV(),
+		strconv.Itoa(record.Expiry.Month), strconv.Itoa(record.Expiry.Year), c.tokenLimiter,
+		c.retryObserver(record, metrics.EndpointToken))
+	endSpan(tokenSpan, err)
+	if err != nil {
+		metrics.ChargesFailed.WithLabelValues(errorCode(err)).Inc()
+		return fmt.Errorf("creating token: %w", err)
+	}
+	metrics.TokensCreated.Inc()
+	c.emitDonation(EventTokenCreated, record, metrics.EndpointToken, "", nil)
+
+	job.token = token
+	return nil
+}
+
+func (c *OmiseClient) charge(job *donationJob) error {
+	record := job.record
+	slog.Debug("charging donation", "row", record.Line, "donation_id", record.ID())
+	waitForLimiter(job.ctx, c.chargeLimiter)
+	description := fmt.Sprintf("charge for %s", record.Name)
+	chargeCtx, chargeSpan := tracing.Tracer().Start(job.ctx, tracing.SpanChargeRequest)
+	chargeID, err := c.chargeService.CreateChargeWithRateLimit(chargeCtx,
+		record.Amount.SubunitString(), job.token.ID, description, c.chargeLimiter,
+		c.retryObserver(record, metrics.EndpointCharge))
+	endSpan(chargeSpan, err)
+	if err != nil {
+		err = unconfirmedCharge(err)
+		metrics.ChargesFailed.WithLabelValues(errorCode(err)).Inc()
+		return fmt.Errorf("creating charge: %w", err)
+	}
+	metrics.ChargesSucceeded.Inc()
+	job.chargeID = chargeID
+	return nil
+}
+
+// finish records the donation's outcome once the stage at endpoint has
+// either charged it or given up on it.
+func (c *OmiseClient) finish(job *donationJob, endpoint string, err error) {
+	endSpan(job.span, err)
+
+	r := job.record
+	if err != nil {
+		slog.Error("donation failed", "row", r.Line, "donation_id", r.ID(), "error", err)
+		c.progress.Failed()
+		job.stats.record(job, OutcomeFailed, errorCode(err), err)
+		c.emitDonation(EventChargeFailed, r, endpoint, errorCode(err), err)
+		c.quarantineRow(r, errorCode(err), IsRetryable(err))
+		return
+	}
+	c.progress.Succeeded()
+	job.stats.record(job, OutcomeSucceeded, "", nil)
+	c.emitDonation(EventChargeCreated, r, endpoint, "", nil)
+}
+
+func waitForLimiter(ctx context.Context, rl *RateLimiter) {
+	_, span := tracing.Tracer().Start(ctx, tracing.SpanWaitForLimiter)
+	rl.Wait()
+	span.End()
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type CheckResult struct {
+	Name string
+	Err  error
+}
+
+func (r CheckResult) OK() bool {
+	return r.Err == nil
+}
+
+func Preflight() []CheckResult {
+	pkey := os.Getenv("OMISE_PKEY")
+	skey := os.Getenv("OMISE_SKEY")
+	httpClient := &http.Client{Timeout: preflightTimeout}
+
+	results := []CheckResult{
+		{Name: "public key", Err: checkKeyFormat("OMISE_PKEY", pkey, publicKeyPrefix)},
+		{Name: "secret key", Err: checkKeyFormat("OMISE_SKEY", skey, secretKeyPrefix)},
+	}
+	_, modeErr := CurrentKeyMode()
+	results = append(results, CheckResult{Name: "key modes", Err: modeErr})
+
+	var account struct {
+		SupportedCurrencies []string `json:"supported_currencies"`
+	}
+	accountErr := getOmiseJSON(httpClient, getEnvString("OMISE_ACCOUNT_URL", defaultAccountURL), skey, &account)
+	results = append(results, CheckResult{Name: "account", Err: accountErr})
+
+	var capability struct {
+		PaymentMethods []struct {
+			Name       string   `json:"name"`
+			Currencies []string `json:"currencies"`
+		} `json:"payment_methods"`
+	}
+	capabilityErr := getOmiseJSON(httpClient, getEnvString("OMISE_CAPABILITY_URL", defaultCapabilityURL), skey, &capability)
+	results = append(results, CheckResult{Name: "capability", Err: capabilityErr})
+
+	currencyErr := fmt.Errorf("skipped: account or capability lookup failed")
+	if accountErr == nil && capabilityErr == nil {
+		var cardCurrencies []string
+		for _, method := range capability.PaymentMethods {
+			if method.Name == cardPaymentMethod {
+				cardCurrencies = append(cardCurrencies, method.Currencies...)
+			}
+		}
+		currencyErr = nil
+		if !containsFold(account.SupportedCurrencies, currency) {
+			currencyErr = fmt.Errorf("account does not support %s", currency)
+		} else if !containsFold(cardCurrencies, currency) {
+			currencyErr = fmt.Errorf("card payments do not support %s", currency)
+		}
+	}
+	results = append(results, CheckResult{Name: "currency " + currency, Err: currencyErr})
+
+	results = append(results,
+		CheckResult{Name: "token endpoint", Err: checkReachable(httpClient, NewTokenService().tokenURL)},
+		CheckResult{Name: "charge endpoint", Err: checkReachable(httpClient, NewChargeService().chargeURL)},
+	)
+
+	return results
+}
+
+func PreflightError(results []CheckResult) error {
+	var failed []string
+	for _, r := range results {
+		if !r.OK() {
+			failed = append(failed, fmt.Sprintf("%s: %v", r.Name, r.Err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("preflight failed: %s", strings.Join(failed, "; "))
+}
+
+func checkKeyFormat(name, key, prefix string) error {
+	if key == "" {
+		return fmt.Errorf("%s is not set", name)
+	}
+	if ClassifyKey(key) == KeyModeUnknown || !strings.HasPrefix(key, prefix) {
+		return fmt.Errorf("%s must start with %stest_ or %slive_", name, prefix, prefix)
+	}
+	return nil
+}
+
+func getOmiseJSON(httpClient *http.Client, url, key string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.SetBasicAuth(key, "")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("API error: %s", parseOmiseError(body))
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("error parsing response: %v", err)
+	}
+	return nil
+}
+
+func checkReachable(httpClient *http.Client, url string) error {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unreachable: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("unhealthy: %s", resp.Status)
+	}
+	return nil
+}
+
+func containsFold(values []string, v string) bool {
+	for _, x := range values {
+		if strings.EqualFold(x, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"go-tamboon/card"
+	"go-tamboon/money"
+	"io"
+)
+
+// Preview is what a run over some input would try to charge, worked out by
+// reading the input without calling Omise. Donors are told apart by name
+// only, since card fingerprints come from the vault, so MAX_DONOR_TOTAL is
+// applied per name. Donations and Total leave out the donations that the
+// spending limits would hold back.
+type Preview struct {
+	Mode        KeyMode
+	Currency    string
+	Files       []FileResult
+	Rows        int
+	Donations   int
+	Total       money.Amount
+	Rejected    []RowError
+	Aborted     *RowError
+	PreRejected map[card.Reason]int
+	Held        int
+	HeldAmount  money.Amount
+	HeldBack    map[string]int
+	Donors      []DonorTotal
+}
+
+// Preview reads every file in paths through open and totals the donations
+// that would be charged, with the rows that would be rejected before
+// reaching Omise. A file that cannot be opened is listed with its error.
+// Rows that would overflow the amount received are rejected, as in a run.
+func (c *OmiseClient) Preview(paths []string, open RecordSource) *Preview {
+	p := &Preview{Mode: c.keyMode, Currency: currency, PreRejected: make(map[card.Reason]int), HeldBack: make(map[string]int)}
+	donors := make(donorTallies)
+	limits := newSpendingLimits()
+	received := &runningTotal{}
+	for _, path := range paths {
+		file := FileResult{Path: path}
+		recordCh, err := open(path)
+		if err != nil {
+			file.Error = err.Error()
+			p.Files = append(p.Files, file)
+			continue
+		}
+		p.Files = append(p.Files, file)
+
+		for record := range recordCh {
+			p.Rows++
+			if record.Reject == nil {
+				if err := received.add(record.Amount); err != nil {
+					record.Reject = &RowError{Line: record.Line, FieldCount: record.Row.Len(), Reason: err.Error()}
+				}
+			}
+			if record.Reject != nil {
+				p.Rejected = append(p.Rejected, *record.Reject)
+				if record.Reject.Abort && p.Aborted == nil {
+					p.Aborted = record.Reject
+				}
+				continue
+			}
+			if err := preValidate(record); err != nil {
+				p.PreRejected[err.Reason]++
+				continue
+			}
+			job := &donationJob{record: record}
+			limitErr := limits.admit(job)
+			if limitErr == nil {
+				if limitErr = limits.admitDonor(job); limitErr != nil {
+					limits.release(job)
+				}
+			}
+			if limitErr != nil {
+				p.Held++
+				p.HeldAmount = plus(p.HeldAmount, record.Amount)
+				p.HeldBack[limitErr.Limit]++
+				continue
+			}
+			p.Donations++
+			p.Total = plus(p.Total, record.Amount)
+			donors.add(donorID(record.Name, ""), record.Name, record.Amount)
+		}
+	}
+	p.Donors = donors.totals()
+	return p
+}
+
+// TopDonors returns up to n donors by amount, largest first.
+func (p *Preview) TopDonors(n int) []DonorTotal {
+	return p.Donors[:min(max(n, 0), len(p.Donors))]
+}
+
+// RenderPreview writes p through the "preview" template of the built-in
+// summary template for lang.
+func RenderPreview(w io.Writer, p *Preview, lang string) error {
+	r, err := NewTemplateRenderer(lang, "")
+	if err != nil {
+		return err
+	}
+	tmpl, err := r.tmpl.Clone()
+	if err != nil {
+		return err
+	}
+	tmpl.Funcs(templateFuncs(&RunResult{Currency: p.Currency}, r.locale))
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, previewTemplate, p); err != nil {
+		return fmt.Errorf("rendering preview: %v", err)
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
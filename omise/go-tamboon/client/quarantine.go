@@ -0,0 +1,47 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// Quarantine receives every row that did not end in a charge, with its
+// original fields in DonationRecord.Row, so the rows can be fixed or
+// resubmitted later. Add is called from several goroutines at once.
+type Quarantine interface {
+	Add(record DonationRecord, reason string, retryable bool)
+}
+
+func (c *OmiseClient) SetQuarantine(q Quarantine) {
+	c.quarantine = q
+}
+
+func (c *OmiseClient) quarantineRow(record DonationRecord, reason string, retryable bool) {
+	if c.quarantine != nil {
+		c.quarantine.Add(record, reason, retryable)
+	}
+}
+
+// IsRetryable reports whether a failed donation may succeed if submitted
+// again later: rate limits, network errors, server errors and soft declines,
+// and donations held back because the run reached its total cap. A charge
+// that may already have been created is never retryable.
+func IsRetryable(err error) bool {
+	var apiErr *APIError
+	var urlErr *url.Error
+	var limitErr *LimitError
+	var unconfirmed *UnconfirmedChargeError
+	switch {
+	case err == nil, errors.As(err, &unconfirmed):
+		return false
+	case errors.As(err, &limitErr):
+		return limitErr.Limit == limitRunTotal
+	case isRateLimitError(err), errors.As(err, &urlErr):
+		return true
+	case errors.As(err, &apiErr):
+		return apiErr.StatusCode >= http.StatusInternalServerError ||
+			apiErr.Code == errorCodeInsufficientFund || apiErr.Code == errorCodeFailedProcessing
+	}
+	return false
+}
@@ -1,13 +1,22 @@
 package client
 
 import (
+	"go-tamboon/metrics"
 	"sync"
+	"time"
 )
 
 type RateLimiter struct {
-	mu     sync.Mutex
-	cond   *sync.Cond
-	paused bool
+	mu          sync.Mutex
+	cond        *sync.Cond
+	paused      bool
+	pausedAt    time.Time
+	pauses      int
+	pausedTotal time.Duration
+	interval    time.Duration
+	next        time.Time
+	onPause     func()
+	onResume    func(paused time.Duration)
 }
 
 func NewRateLimiter() *RateLimiter {
@@ -16,17 +25,59 @@ func NewRateLimiter() *RateLimiter {
 	return rl
 }
 
+// newStageLimiter spaces requests evenly at rps per second on top of the
+// pauses; an rps of zero or less only pauses.
+func newStageLimiter(rps int, onPause func(), onResume func(time.Duration)) *RateLimiter {
+	rl := NewRateLimiter()
+	if rps > 0 {
+		rl.interval = time.Second / time.Duration(rps)
+	}
+	rl.onPause = onPause
+	rl.onResume = onResume
+	return rl
+}
+
 func (rl *RateLimiter) Pause() {
 	rl.mu.Lock()
-	rl.paused = true
+	started := !rl.paused
+	if started {
+		rl.paused = true
+		rl.pausedAt = time.Now()
+		rl.pauses++
+	}
 	rl.mu.Unlock()
+
+	if started && rl.onPause != nil {
+		rl.onPause()
+	}
 }
 
 func (rl *RateLimiter) Resume() {
 	rl.mu.Lock()
+	ended := rl.paused
+	var paused time.Duration
+	if ended {
+		paused = time.Since(rl.pausedAt)
+		rl.pausedTotal += paused
+		metrics.RateLimitPauseSeconds.Add(paused.Seconds())
+	}
 	rl.paused = false
 	rl.cond.Broadcast()
 	rl.mu.Unlock()
+
+	if ended && rl.onResume != nil {
+		rl.onResume(paused)
+	}
+}
+
+func (rl *RateLimiter) Stats() (pauses int, pausedTotal time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	pausedTotal = rl.pausedTotal
+	if rl.paused {
+		pausedTotal += time.Since(rl.pausedAt)
+	}
+	return rl.pauses, pausedTotal
 }
 
 func (rl *RateLimiter) WaitIfPaused() {
@@ -36,3 +87,22 @@ func (rl *RateLimiter) WaitIfPaused() {
 	}
 	rl.mu.Unlock()
 }
+
+// Wait blocks while the limiter is paused and then until the next request
+// slot is free.
+func (rl *RateLimiter) Wait() {
+	rl.WaitIfPaused()
+	if rl.interval <= 0 {
+		return
+	}
+
+	rl.mu.Lock()
+	slot := rl.next
+	if now := time.Now(); slot.Before(now) {
+		slot = now
+	}
+	rl.next = slot.Add(rl.interval)
+	rl.mu.Unlock()
+
+	time.Sleep(time.Until(slot))
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"fmt"
+	"go-tamboon/money"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ID identifies a donation by the path of its file and its line, so files
+// with the same name in different directories do not share IDs.
+func (r DonationRecord) ID() string {
+	return fmt.Sprintf("%s:%d", filepath.Clean(r.Source), r.Line)
+}
+
+type Amount = money.Amount
+
+func ParseAmount(s string) (Amount, error) {
+	subunits, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return Amount{}, fmt.Errorf("amount is not an integer")
+	}
+	if subunits <= 0 {
+		return Amount{}, fmt.Errorf("amount must be positive")
+	}
+	return money.New(subunits, currency), nil
+}
+
+type Expiry struct {
+	Month int
+	Year  int
+}
+
+func ParseExpiry(month, year string) (Expiry, error) {
+	m, err := strconv.Atoi(strings.TrimSpace(month))
+	if err != nil {
+		return Expiry{}, fmt.Errorf("expiration month is not a number")
+	}
+	y, err := strconv.Atoi(strings.TrimSpace(year))
+	if err != nil {
+		return Expiry{}, fmt.Errorf("expiration year is not a number")
+	}
+	return NewExpiry(m, y)
+}
+
+func NewExpiry(month, year int) (Expiry, error) {
+	if month < 1 || month > 12 {
+		return Expiry{}, fmt.Errorf("expiration month must be between 1 and 12")
+	}
+	if year < minExpiryYear || year > maxExpiryYear {
+		return Expiry{}, fmt.Errorf("expiration year must be between %d and %d", minExpiryYear, maxExpiryYear)
+	}
+	return Expiry{Month: month, Year: year}, nil
+}
+
+// Card holds the card number and security code. It only ever formats as a
+// masked number so it cannot end up in logs or summaries by accident.
+type Card struct {
+	number string
+	cvv    string
+}
+
+func NewCard(number, cvv string) Card {
+	return Card{number: strings.TrimSpace(number), cvv: strings.TrimSpace(cvv)}
+}
+
+func (c Card) Number() string { return c.number }
+
+func (c Card) CVV() string { return c.cvv }
+
+func (c Card) Last4() string {
+	if len(c.number) < 4 {
+		return ""
+	}
+	return c.number[len(c.number)-4:]
+}
+
+func (c Card) String() string {
+	if c.number == "" {
+		return ""
+	}
+	return "****" + c.Last4()
+}
+
+func (c Card) GoString() string { return c.String() }
+
+func (c Card) Format(f fmt.State, verb rune) { fmt.Fprint(f, c.String()) }
+
+func (c Card) MarshalText() ([]byte, error) { return []byte(c.String()), nil }
+
+func (c Card) LogValue() slog.Value { return slog.StringValue(c.String()) }
+
+// RawRow holds the fields of a row as read from the file, card number and
+// security code included, for writing the row back out. Like Card it only
+// ever formats as a field count.
+type RawRow struct {
+	fields []string
+}
+
+func NewRawRow(fields []string) RawRow {
+	return RawRow{fields: fields}
+}
+
+func (r RawRow) Fields() []string { return r.fields }
+
+func (r RawRow) Len() int { return len(r.fields) }
+
+func (r RawRow) String() string {
+	if len(r.fields) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("[%d fields]", len(r.fields))
+}
+
+func (r RawRow) GoString() string { return r.String() }
+
+func (r RawRow) Format(f fmt.State, verb rune) { fmt.Fprint(f, r.String()) }
+
+func (r RawRow) MarshalText() ([]byte, error) { return []byte(r.String()), nil }
+
+func (r RawRow) LogValue() slog.Value { return slog.StringValue(r.String()) }
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"go-tamboon/card"
+	"go-tamboon/display"
+	"go-tamboon/money"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+//go:embed templates/*.tmpl
+var builtinTemplates embed.FS
+
+// Renderer writes a human or machine readable summary of a run.
+type Renderer interface {
+	Render(w io.Writer, result *RunResult) error
+}
+
+// TextRenderer writes the built-in English summary.
+type TextRenderer struct{}
+
+type JSONRenderer struct{}
+
+// TemplateRenderer writes the summary through a text/template, either a
+// built-in one or one supplied by the user. Besides the RunResult, templates
+// can call the functions listed in templateFuncs.
+type TemplateRenderer struct {
+	tmpl   *template.Template
+	locale money.Locale
+}
+
+var englishRenderer = sync.OnceValues(func() (*TemplateRenderer, error) {
+	return NewTemplateRenderer(langEnglish, "")
+})
+
+// NewRenderer returns the renderer for format. lang picks the built-in text
+// template and the number format; templatePath replaces the built-in
+// template with a user-supplied one.
+func NewRenderer(format, lang, templatePath string) (Renderer, error) {
+	switch strings.ToLower(format) {
+	case "", summaryFormatText:
+		if templatePath == "" && (lang == "" || lang == langEnglish) {
+			return TextRenderer{}, nil
+		}
+		return NewTemplateRenderer(lang, templatePath)
+	case summaryFormatJSON:
+		if templatePath != "" {
+			return nil, fmt.Errorf("summary templates only apply to %s summaries", summaryFormatText)
+		}
+		return JSONRenderer{}, nil
+	}
+	return nil, fmt.Errorf("unknown summary format %q (want %s or %s)", format, summaryFormatText, summaryFormatJSON)
+}
+
+// NewTemplateRenderer parses the template at path, or the built-in template
+// for lang when path is empty.
+func NewTemplateRenderer(lang, path string) (*TemplateRenderer, error) {
+	if lang == "" {
+		lang = langEnglish
+	}
+
+	var name, text string
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading summary template: %v", err)
+		}
+		name, text = filepath.Base(path), string(b)
+	} else {
+		b, err := builtinTemplates.ReadFile(builtinTemplateDir + "/" + lang + ".tmpl")
+		if err != nil {
+			return nil, fmt.Errorf("unknown summary language %q (want %s or %s)", lang, langEnglish, langThai)
+		}
+		name, text = lang, string(b)
+	}
+
+	locale := money.LookupLocale(lang)
+	tmpl, err := template.New(name).Funcs(templateFuncs(&RunResult{}, locale)).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing summary template: %v", err)
+	}
+	return &TemplateRenderer{tmpl: tmpl, locale: locale}, nil
+}
+
+func (JSONRenderer) Render(w io.Writer, result *RunResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
+
+// Render prints one section per file when the run covered several files,
+// followed by the totals; otherwise just the totals.
+func (TextRenderer) Render(w io.Writer, result *RunResult) error {
+	r, err := englishRenderer()
+	if err != nil {
+		return err
+	}
+	return r.Render(w, result)
+}
+
+func (r *TemplateRenderer) Render(w io.Writer, result *RunResult) error {
+	tmpl, err := r.tmpl.Clone()
+	if err != nil {
+		return err
+	}
+	tmpl.Funcs(templateFuncs(result, r.locale))
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, result); err != nil {
+		return fmt.Errorf("rendering summary: %v", err)
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// templateFuncs are the helpers available to summary templates. Padding
+// and alignment count display cells rather than bytes or runes, so Thai
+// and CJK text lines up.
+func templateFuncs(result *RunResult, locale money.Locale) template.FuncMap {
+	return template.FuncMap{
+		"currency": func() string { return result.Currency },
+		"money":    func(a money.Amount) string { return a.Format(locale) },
+		"top":      func() int { return topDonors },
+		"padLeft":  display.PadLeft,
+		"padRight": display.PadRight,
+		"width":    display.Width,
+		"indent":   func(n int) string { return strings.Repeat(" ", n) },
+		"upper":    func(v any) string { return strings.ToUpper(fmt.Sprint(v)) },
+		"duration": func(d time.Duration) string { return d.Round(time.Millisecond).String() },
+		"percent":  func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) },
+		"sum": func(counts map[card.Reason]int) int {
+			total := 0
+			for _, count := range counts {
+				total += count
+			}
+			return total
+		},
+		"bucket": func(b SizeBucket, under, between, over string) string {
+			switch {
+			case b.To == nil:
+				return fmt.Sprintf(over, b.From.Format(locale))
+			case b.From.IsZero():
+				return fmt.Sprintf(under, b.From.Format(locale), b.To.Format(locale))
+			}
+			return fmt.Sprintf(between, b.From.Format(locale), b.To.Format(locale))
+		},
+		"nameWidth": func(donors []DonorTotal) int {
+			w := 0
+			for _, d := range donors {
+				w = max(w, display.Width(d.Name))
+			}
+			return w
+		},
+		"processedFiles": func(files []FileResult) int {
+			n := 0
+			for _, f := range files {
+				if f.Error == "" {
+					n++
+				}
+			}
+			return n
+		},
+		"failedFiles": func(files []FileResult) int {
+			n := 0
+			for _, f := range files {
+				if f.Error != "" {
+					n++
+				}
+			}
+			return n
+		},
+	}
+}
@@ -0,0 +1,242 @@
+package client
+
+import (
+	"cmp"
+	"go-tamboon/card"
+	"go-tamboon/logging"
+	"go-tamboon/money"
+	"slices"
+	"time"
+)
+
+type Outcome string
+
+const (
+	OutcomeSucceeded   Outcome = "succeeded"
+	OutcomeFailed      Outcome = "failed"
+	OutcomePreRejected Outcome = "pre_rejected"
+	OutcomeDuplicate   Outcome = "duplicate"
+	OutcomeHeld        Outcome = "held"
+)
+
+// DonationOutcome is what happened to one parsed donation. Card holds the
+// masked number and Error is redacted, so outcomes are safe to store.
+type DonationOutcome struct {
+	ID        string  `json:"id"`
+	DonorID   string  `json:"donor_id"`
+	Source    string  `json:"source,omitempty"`
+	Line      int     `json:"line"`
+	Name      string  `json:"name"`
+	Amount    Amount  `json:"amount"`
+	Card      string  `json:"card"`
+	Outcome   Outcome `json:"outcome"`
+	ChargeID  string  `json:"charge_id,omitempty"`
+	Reason    string  `json:"reason,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	Retryable bool    `json:"retryable,omitempty"`
+
+	// Transforms names the ROW_TRANSFORMS applied to the row, in order.
+	Transforms []string `json:"transforms,omitempty"`
+
+	// DuplicateOf is the ID of an earlier donation, from this run or an
+	// earlier one, with the same card, amount and name.
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+
+	// Previous is the outcome this one replaced when the donation was retried.
+	Previous *DonationOutcome `json:"previous,omitempty"`
+}
+
+// DonorTotal is what one person donated successfully. ID is the card
+// fingerprint or, without one, the normalised name; Names holds every
+// spelling the donor used, most frequent first, and Name is the first of them.
+type DonorTotal struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Names     []string     `json:"names"`
+	Amount    money.Amount `json:"amount"`
+	Donations int          `json:"donations"`
+}
+
+// Summary aggregates a set of donations, all in the run's currency.
+type Summary struct {
+	Received     money.Amount        `json:"received"`
+	Donated      money.Amount        `json:"donated"`
+	Faulty       money.Amount        `json:"faulty"`
+	Donations    int                 `json:"donations"`
+	Succeeded    int                 `json:"succeeded"`
+	Failed       int                 `json:"failed"`
+	UniqueDonors int                 `json:"unique_donors"`
+	Retried      int                 `json:"retried,omitempty"`
+	Recovered    int                 `json:"recovered,omitempty"`
+	Duplicates   int                 `json:"duplicates,omitempty"`
+	HeldBack     map[string]int      `json:"held_back,omitempty"`
+	PreRejected  map[card.Reason]int `json:"pre_rejected"`
+	Rejected     []RowError          `json:"rejected"`
+	Aborted      *RowError           `json:"aborted,omitempty"`
+	Donors       []DonorTotal        `json:"donors"`
+	Outcomes     []DonationOutcome   `json:"outcomes"`
+
+	// FailureReasons counts failed charges by error code. SuccessRate,
+	// Percentiles and SizeBuckets describe the successful donations.
+	FailureReasons map[string]int `json:"failure_reasons"`
+	SuccessRate    float64        `json:"success_rate"`
+	Percentiles    []Percentile   `json:"percentiles"`
+	SizeBuckets    []SizeBucket   `json:"size_buckets"`
+}
+
+type Percentile struct {
+	Percent int          `json:"percent"`
+	Amount  money.Amount `json:"amount"`
+}
+
+// SizeBucket counts successful donations of at least From and less than To.
+// The last bucket has no upper bound.
+type SizeBucket struct {
+	From  money.Amount  `json:"from"`
+	To    *money.Amount `json:"to,omitempty"`
+	Count int           `json:"count"`
+}
+
+type FileResult struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Summary
+}
+
+// SetFileHashes records the SHA-256 of each file, by path, so that a retry
+// can check it reads the same files.
+func (r *RunResult) SetFileHashes(hashes map[string]string) {
+	for i := range r.Files {
+		r.Files[i].SHA256 = hashes[r.Files[i].Path]
+	}
+}
+
+type StageConcurrency struct {
+	Endpoint string `json:"endpoint"`
+	Final    int    `json:"final"`
+	Peak     int    `json:"peak"`
+	Min      int    `json:"min"`
+	Max      int    `json:"max"`
+}
+
+// RunResult is everything a donation run produced. The embedded Summary
+// covers all files; Files is only set for ProcessDonationFiles.
+type RunResult struct {
+	Mode        KeyMode            `json:"mode"`
+	Started     time.Time          `json:"started_at"`
+	Finished    time.Time          `json:"finished_at"`
+	Duration    time.Duration      `json:"duration_ns"`
+	Currency    string             `json:"currency"`
+	Concurrency []StageConcurrency `json:"concurrency"`
+	Files       []FileResult       `json:"files,omitempty"`
+	Summary
+}
+
+// AveragePerPerson is the amount donated per unique donor.
+func (s *Summary) AveragePerPerson() money.Amount {
+	return s.Donated.Div(int64(s.UniqueDonors))
+}
+
+// TopDonors returns up to n donors by amount donated, largest first. Donors
+// who gave the same amount are ordered by name, then by ID.
+func (s *Summary) TopDonors(n int) []DonorTotal {
+	return s.Donors[:min(max(n, 0), len(s.Donors))]
+}
+
+// Held returns the donations held back by a spending limit, by limit.
+func (s *Summary) Held() []DonationOutcome {
+	var held []DonationOutcome
+	for _, o := range s.Outcomes {
+		if o.Outcome == OutcomeHeld {
+			held = append(held, o)
+		}
+	}
+	slices.SortStableFunc(held, func(a, b DonationOutcome) int { return cmp.Compare(a.Reason, b.Reason) })
+	return held
+}
+
+func (s *Summary) Failures() []DonationOutcome {
+	var failures []DonationOutcome
+	for _, o := range s.Outcomes {
+		if o.Outcome != OutcomeSucceeded {
+			failures = append(failures, o)
+		}
+	}
+	return failures
+}
+
+func (c *OmiseClient) newRunResult(total *donationStats, started time.Time) *RunResult {
+	finished := time.Now()
+	result := &RunResult{
+		Mode: c.keyMode, Started: started, Finished: finished, Duration: finished.Sub(started),
+		Currency: currency, Summary: total.summary(),
+	}
+	for _, l := range c.concurrency() {
+		result.Concurrency = append(result.Concurrency, StageConcurrency{
+			Endpoint: l.endpoint, Final: l.Limit(), Peak: l.Peak(), Min: l.min, Max: l.max,
+		})
+	}
+	return result
+}
+
+func (s *donationStats) summary() Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := Summary{
+		Received:    s.totalAmount,
+		Donated:     s.successAmount,
+		Faulty:      minus(s.totalAmount, s.successAmount),
+		Donations:   s.totalCount,
+		Succeeded:   s.successCount,
+		PreRejected: make(map[card.Reason]int, len(s.preRejected)),
+		Rejected:    slices.Clone(s.rejected),
+		Aborted:     s.abort,
+		Outcomes:    slices.Clone(s.outcomes),
+	}
+	for reason, count := range s.preRejected {
+		summary.PreRejected[reason] = count
+	}
+	summary.Donors = s.donors.totals()
+	summary.UniqueDonors = len(summary.Donors)
+	summary.describe()
+	slices.SortFunc(summary.Outcomes, func(a, b DonationOutcome) int {
+		return cmp.Or(cmp.Compare(a.Source, b.Source), cmp.Compare(a.Line, b.Line))
+	})
+	return summary
+}
+
+// minus subtracts a part of a total from it, which cannot overflow.
+func minus(total, part money.Amount) money.Amount {
+	diff, _ := total.Sub(part)
+	return diff
+}
+
+func sortDonors(donors []DonorTotal) {
+	slices.SortFunc(donors, func(a, b DonorTotal) int {
+		return cmp.Or(cmp.Compare(b.Amount.Subunits, a.Amount.Subunits), cmp.Compare(a.Name, b.Name), cmp.Compare(a.ID, b.ID))
+	})
+}
+
+func (s *donationStats) record(job *donationJob, outcome Outcome, reason string, err error) {
+	r := job.record
+	o := DonationOutcome{
+		ID: r.ID(), DonorID: donorID(r.Name, job.token.Fingerprint), Source: r.Source, Line: r.Line, Name: r.Name,
+		Amount: r.Amount, Card: r.Card.String(), Outcome: outcome, Reason: reason,
+		ChargeID: job.chargeID, DuplicateOf: job.duplicateOf, Transforms: r.Transforms,
+	}
+	if err != nil {
+		o.Error = logging.Redact(err.Error())
+		o.Retryable = (outcome == OutcomeFailed || outcome == OutcomeHeld) && IsRetryable(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outcomes = append(s.outcomes, o)
+	if outcome == OutcomeSucceeded {
+		s.successCount++
+		s.successAmount = plus(s.successAmount, r.Amount)
+		s.donors.add(o.DonorID, r.Name, r.Amount)
+	}
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-tamboon/card"
+	"io"
+	"maps"
+	"slices"
+)
+
+// LoadRunResult reads a report written by JSONRenderer.
+func LoadRunResult(r io.Reader) (*RunResult, error) {
+	var result RunResult
+	if err := json.NewDecoder(r).Decode(&result); err != nil {
+		return nil, fmt.Errorf("reading run report: %v", err)
+	}
+	return &result, nil
+}
+
+// RetryableIDs returns the IDs of the donations in result that failed with a
+// retryable error, or were held back by the run total cap, and may succeed if
+// charged again.
+func RetryableIDs(result *RunResult) map[string]bool {
+	ids := make(map[string]bool)
+	for _, o := range result.Outcomes {
+		if o.Retryable {
+			ids[o.ID] = true
+		}
+	}
+	return ids
+}
+
+// CheckRetryInputs refuses a retry of previous unless every input file, by
+// path, is one of its files with the same SHA-256. Donations are identified
+// by path and line, so any other file would have the wrong rows charged.
+func CheckRetryInputs(previous *RunResult, hashes map[string]string) error {
+	reported := make(map[string]string, len(previous.Files))
+	for _, f := range previous.Files {
+		reported[f.Path] = f.SHA256
+	}
+	paths := slices.Sorted(maps.Keys(hashes))
+	for _, path := range paths {
+		want, ok := reported[path]
+		switch {
+		case !ok:
+			return fmt.Errorf("%s is not an input of the report", path)
+		case want == "":
+			return fmt.Errorf("report has no fingerprint for %s, cannot check it is the same file", path)
+		case want != hashes[path]:
+			return fmt.Errorf("%s has changed since the report was produced", path)
+		}
+	}
+	return nil
+}
+
+// OnlyDonations wraps open so that only the donations whose ID is in ids are
+// read. Every other row, including malformed ones, is skipped.
+func OnlyDonations(open RecordSource, ids map[string]bool) RecordSource {
+	return func(path string) (<-chan DonationRecord, error) {
+		recordCh, err := open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		filtered := make(chan DonationRecord)
+		go func() {
+			defer close(filtered)
+			for record := range recordCh {
+				if record.Reject == nil && ids[record.ID()] {
+					filtered <- record
+				}
+			}
+		}()
+		return filtered, nil
+	}
+}
+
+// MergeRetry combines a previous run with a run that retried some of its
+// donations. Each retried outcome replaces the original one, which is kept in
+// its Previous field, and the totals are recomputed from the merged outcomes.
+func MergeRetry(previous, retried *RunResult) *RunResult {
+	retriedByID := make(map[string]DonationOutcome, len(retried.Outcomes))
+	for _, o := range retried.Outcomes {
+		retriedByID[o.ID] = o
+	}
+
+	outcomes := make([]DonationOutcome, 0, len(previous.Outcomes))
+	for _, o := range previous.Outcomes {
+		if r, ok := retriedByID[o.ID]; ok {
+			original := o
+			r.Source = o.Source
+			r.Previous = &original
+			o = r
+		}
+		outcomes = append(outcomes, o)
+	}
+
+	merged := &RunResult{
+		Mode:        retried.Mode,
+		Started:     previous.Started,
+		Finished:    retried.Finished,
+		Duration:    previous.Duration + retried.Duration,
+		Currency:    previous.Currency,
+		Concurrency: retried.Concurrency,
+		Summary:     summarize(outcomes, previous.Rejected, previous.Aborted),
+	}
+	for _, file := range previous.Files {
+		var fileOutcomes []DonationOutcome
+		for _, o := range outcomes {
+			if o.Source == file.Path {
+				fileOutcomes = append(fileOutcomes, o)
+			}
+		}
+		merged.Files = append(merged.Files, FileResult{
+			Path:    file.Path,
+			SHA256:  file.SHA256,
+			Error:   file.Error,
+			Summary: summarize(fileOutcomes, file.Rejected, file.Aborted),
+		})
+	}
+	return merged
+}
+
+func summarize(outcomes []DonationOutcome, rejected []RowError, aborted *RowError) Summary {
+	summary := Summary{
+		PreRejected: make(map[card.Reason]int),
+		Rejected:    rejected,
+		Aborted:     aborted,
+		Outcomes:    outcomes,
+	}
+
+	donors := make(donorTallies)
+	for _, o := range outcomes {
+		summary.Donations++
+		summary.Received = plus(summary.Received, o.Amount)
+		if o.Previous != nil {
+			summary.Retried++
+		}
+
+		switch o.Outcome {
+		case OutcomeSucceeded:
+			summary.Succeeded++
+			summary.Donated = plus(summary.Donated, o.Amount)
+			if o.Previous != nil {
+				summary.Recovered++
+			}
+			id := o.DonorID
+			if id == "" {
+				id = donorID(o.Name, "")
+			}
+			donors.add(id, o.Name, o.Amount)
+		case OutcomePreRejected:
+			summary.PreRejected[card.Reason(o.Reason)]++
+		}
+	}
+	summary.Faulty = minus(summary.Received, summary.Donated)
+
+	summary.Donors = donors.totals()
+	summary.UniqueDonors = len(summary.Donors)
+	summary.describe()
+	return summary
+}
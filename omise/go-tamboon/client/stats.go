@@ -0,0 +1,85 @@
+package client
+
+import (
+	"go-tamboon/money"
+	"slices"
+)
+
+// describe fills in the failure breakdown, success rate and size
+// distribution from the summary's outcomes.
+func (s *Summary) describe() {
+	s.Failed = 0
+	s.Duplicates = 0
+	s.HeldBack = nil
+	s.FailureReasons = make(map[string]int)
+	var sizes []int64
+	for _, o := range s.Outcomes {
+		if o.DuplicateOf != "" {
+			s.Duplicates++
+		}
+		switch o.Outcome {
+		case OutcomeSucceeded:
+			sizes = append(sizes, o.Amount.Subunits)
+		case OutcomeFailed:
+			s.Failed++
+			s.FailureReasons[o.Reason]++
+		case OutcomeHeld:
+			if s.HeldBack == nil {
+				s.HeldBack = make(map[string]int)
+			}
+			s.HeldBack[o.Reason]++
+		}
+	}
+	if s.Donations > 0 {
+		s.SuccessRate = float64(s.Succeeded) / float64(s.Donations)
+	}
+
+	slices.Sort(sizes)
+	s.Percentiles = nil
+	for _, p := range percentiles {
+		s.Percentiles = append(s.Percentiles, Percentile{Percent: p, Amount: money.New(percentile(sizes, p), currency)})
+	}
+	s.SizeBuckets = bucketSizes(sizes)
+}
+
+// Median is the median successful donation.
+func (s *Summary) Median() money.Amount {
+	for _, p := range s.Percentiles {
+		if p.Percent == percentileMedian {
+			return p.Amount
+		}
+	}
+	return money.Amount{}
+}
+
+// percentile returns the nearest-rank percentile p of sorted sizes.
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+func bucketSizes(sorted []int64) []SizeBucket {
+	unit := int64(1)
+	for range money.Exponent(currency) {
+		unit *= 10
+	}
+
+	buckets := []SizeBucket{{From: money.New(0, currency)}}
+	for _, bound := range sizeBuckets {
+		to := money.New(bound*unit, currency)
+		buckets[len(buckets)-1].To = &to
+		buckets = append(buckets, SizeBucket{From: to})
+	}
+
+	i := 0
+	for _, size := range sorted {
+		for buckets[i].To != nil && size >= buckets[i].To.Subunits {
+			i++
+		}
+		buckets[i].Count++
+	}
+	return buckets
+}
@@ -1,8 +1,10 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"go-tamboon/metrics"
 	"io"
 	"net/http"
 	"net/url"
@@ -12,7 +14,8 @@ import (
 )
 
 type TokenService struct {
-	tokenURL string
+	tokenURL   string
+	httpClient *http.Client
 }
 
 func NewTokenService() *TokenService {
@@ -21,11 +24,12 @@ func NewTokenService() *TokenService {
 		tokenURL = defaultTokenURL
 	}
 	return &TokenService{
-		tokenURL: tokenURL,
+		tokenURL:   tokenURL,
+		httpClient: newHTTPClient(),
 	}
 }
 
-func (ts *TokenService) CreateToken(name, ccNumber, cvv, expMonth, expYear string) (string, error) {
+func (ts *TokenService) CreateToken(ctx context.Context, name, ccNumber, cvv, expMonth, expYear string) (Token, error) {
 	data := url.Values{}
 	data.Set("card[name]", name)
 	data.Set("card[number]", ccNumber)
@@ -33,54 +37,62 @@ func (ts *TokenService) CreateToken(name, ccNumber, cvv, expMonth, expYear strin
 	data.Set("card[expiration_month]", expMonth)
 	data.Set("card[expiration_year]", expYear)
 
-	req, err := http.NewRequest("POST", ts.tokenURL, strings.NewReader(data.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", ts.tokenURL, strings.NewReader(data.Encode()))
 	if err != nil {
-		return "", fmt.Errorf("error creating request: %v", err)
+		return Token{}, fmt.Errorf("error creating request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.SetBasicAuth(os.Getenv("OMISE_PKEY"), "")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	start := time.Now()
+	resp, err := ts.httpClient.Do(req)
+	metrics.ObserveRequest(metrics.EndpointToken, start)
 	if err != nil {
-		return "", fmt.Errorf("error making request: %v", err)
+		return Token{}, fmt.Errorf("error making request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("error reading response: %v", err)
+		return Token{}, fmt.Errorf("error reading response: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		errorMsg := parseOmiseError(body)
-		return "", fmt.Errorf("API error: %s", errorMsg)
+		return Token{}, parseAPIError(resp.StatusCode, body)
 	}
 
 	var tokenResponse map[string]interface{}
 	if err := json.Unmarshal(body, &tokenResponse); err != nil {
-		return "", fmt.Errorf("error parsing token response: %v", err)
+		return Token{}, fmt.Errorf("error parsing token response: %w", err)
 	}
 
 	tokenID, ok := tokenResponse["id"].(string)
 	if !ok {
-		return "", fmt.Errorf("error extracting token ID from response")
+		return Token{}, fmt.Errorf("error extracting token ID from response")
 	}
 
-	return tokenID, nil
+	token := Token{ID: tokenID}
+	if card, ok := tokenResponse["card"].(map[string]interface{}); ok {
+		token.Fingerprint, _ = card["fingerprint"].(string)
+	}
+	return token, nil
 }
 
-func (ts *TokenService) CreateTokenWithRateLimit(name, ccNumber, cvv, expMonth, expYear string, rl *RateLimiter) (string, error) {
+func (ts *TokenService) CreateTokenWithRateLimit(ctx context.Context, name, ccNumber, cvv, expMonth, expYear string, rl *RateLimiter, onRetry func(attempt int, wait time.Duration, err error)) (Token, error) {
 	retries := 0
 	for {
-		tokenID, err := ts.CreateToken(name, ccNumber, cvv, expMonth, expYear)
+		token, err := ts.CreateToken(ctx, name, ccNumber, cvv, expMonth, expYear)
 		if err != nil && isRateLimitError(err) {
 			if retries >= maxRetries {
-				return "", fmt.Errorf("rate limit: exceeded max retries")
+				return Token{}, fmt.Errorf("rate limit: exceeded max retries")
+			}
+			metrics.Retries.WithLabelValues(metrics.EndpointToken).Inc()
+			waitTime := time.Duration(retries+1) * retryBaseWait
+			if onRetry != nil {
+				onRetry(retries+1, waitTime, err)
 			}
 			rl.Pause()
-			waitTime := time.Duration(5*(retries+1)) * time.Second
 			go func() {
 				time.Sleep(waitTime)
 				rl.Resume()
@@ -89,6 +101,6 @@ func (ts *TokenService) CreateTokenWithRateLimit(name, ccNumber, cvv, expMonth,
 			retries++
 			continue
 		}
-		return tokenID, err
+		return token, err
 	}
 }
@@ -1,27 +1,91 @@
 package client
 
-import "sync"
+import (
+	"fmt"
+	"go-tamboon/card"
+	"go-tamboon/money"
+	"go-tamboon/progress"
+	"sync"
+	"time"
+)
 
 type DonationRecord struct {
-	Name           string
-	AmountSubunits string
-	CCNumber       string
-	CVV            string
-	ExpMonth       string
-	ExpYear        string
+	Source     string
+	Line       int
+	Name       string
+	Amount     Amount
+	Card       Card
+	Expiry     Expiry
+	Transforms []string
+	Row        RawRow
+	Reject     *RowError
+
+	ParseStarted  time.Time
+	ParseFinished time.Time
+}
+
+type RowError struct {
+	Line       int    `json:"line"`
+	FieldCount int    `json:"field_count"`
+	Reason     string `json:"reason"`
+	Abort      bool   `json:"abort,omitempty"`
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("line %d: %s (%d fields)", e.Line, e.Reason, e.FieldCount)
 }
 
 type OmiseClient struct {
-	tokenService  *TokenService
-	chargeService *ChargeService
-	rateLimiter   *RateLimiter
+	tokenService      *TokenService
+	chargeService     *ChargeService
+	tokenLimiter      *RateLimiter
+	chargeLimiter     *RateLimiter
+	tokenConcurrency  *ConcurrencyLimiter
+	chargeConcurrency *ConcurrencyLimiter
+	keyMode           KeyMode
+	progress          *progress.Reporter
+	observers         []Observer
+	quarantine        Quarantine
+	chargeHistory     ChargeHistory
+}
+
+// Token is a card token created by the vault. Fingerprint identifies the
+// card across tokens and is empty if the vault did not return one.
+type Token struct {
+	ID          string
+	Fingerprint string
 }
 
+// donorTally accumulates the successful donations of one donor, keyed by
+// donorID, along with every spelling of their name.
+type donorTally struct {
+	amount    money.Amount
+	donations int
+	names     map[string]int
+}
+
+type donorTallies map[string]*donorTally
+
+type RecordSource func(path string) (<-chan DonationRecord, error)
+
 type donationStats struct {
 	mu            sync.Mutex
 	totalCount    int
-	totalAmount   int64
+	totalAmount   money.Amount
 	successCount  int
-	successAmount int64
-	donorAmounts  map[string]int64
+	successAmount money.Amount
+	donors        donorTallies
+	preRejected   map[card.Reason]int
+	rejected      []RowError
+	abort         *RowError
+	outcomes      []DonationOutcome
+	err           error
+}
+
+// runningTotal is the amount received so far across every stream of a run.
+// Rows that would overflow it are rejected before they are charged, so no
+// other total within the run can overflow.
+type runningTotal struct {
+	mu     sync.Mutex
+	amount money.Amount
 }
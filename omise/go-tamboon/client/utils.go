@@ -2,101 +2,103 @@ package client
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"sort"
+	"go-tamboon/tracing"
+	"net/http"
+	"net/url"
 	"strings"
 )
 
 const (
-	msgUnknownError        = "unknown error"
-	msgDone                = "done."
-	msgTotalReceived       = "        total received: THB %10s\n"
-	msgSuccessfullyDonated = "  successfully donated: THB %10s\n"
-	msgFaultyDonation      = "       faulty donation: THB %10s\n"
-	msgAveragePerPerson    = "    average per person: THB %10s\n"
-	msgTopDonors           = "            top donors:"
+	msgUnknownError = "unknown error"
 )
 
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API error: %s", e.Message)
+}
+
+// UnconfirmedChargeError is a charge request that failed after it may have
+// reached Omise, through a network or server error. The charge may have been
+// created, so the donation must be checked rather than charged again.
+type UnconfirmedChargeError struct {
+	Err error
+}
+
+func (e *UnconfirmedChargeError) Error() string {
+	return fmt.Sprintf("charge may have been created: %v", e.Err)
+}
+
+func (e *UnconfirmedChargeError) Unwrap() error { return e.Err }
+
+// unconfirmedCharge wraps err if it leaves open whether the charge was made.
+func unconfirmedCharge(err error) error {
+	var apiErr *APIError
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) || (errors.As(err, &apiErr) && apiErr.StatusCode >= http.StatusInternalServerError) {
+		return &UnconfirmedChargeError{Err: err}
+	}
+	return err
+}
+
 func parseOmiseError(body []byte) string {
+	return parseAPIError(0, body).Message
+}
+
+func parseAPIError(statusCode int, body []byte) *APIError {
+	apiErr := &APIError{StatusCode: statusCode, Message: msgUnknownError}
+
 	var errorResponse map[string]interface{}
 	if err := json.Unmarshal(body, &errorResponse); err != nil {
-		return msgUnknownError
+		return apiErr
 	}
 
 	if object, ok := errorResponse["object"].(string); ok && object == "error" {
 		if message, ok := errorResponse["message"].(string); ok {
-			return message
+			apiErr.Message = message
+		}
+		if code, ok := errorResponse["code"].(string); ok {
+			apiErr.Code = code
 		}
 	}
 
-	return msgUnknownError
+	return apiErr
 }
 
-func formatTHB(subunits int64) string {
-	val := float64(subunits) / 100.0
-	s := fmt.Sprintf("%.2f", val)
-	n := len(s)
-	dot := n - 3
-	var out []byte
-	for i := 0; i < dot; i++ {
-		if (dot-i)%3 == 0 && i != 0 {
-			out = append(out, ',')
-		}
-		out = append(out, s[i])
-	}
-	out = append(out, s[dot:]...)
-	return string(out)
+func newHTTPClient() *http.Client {
+	return &http.Client{Transport: tracing.Transport(http.DefaultTransport)}
 }
 
-func printSummary(s *donationStats) {
-	faultyAmount := s.totalAmount - s.successAmount
-	avgPerPerson := int64(0)
-	if s.totalCount > 0 {
-		avgPerPerson = s.totalAmount / int64(s.totalCount)
-	}
-
-	type donorPair struct {
-		name   string
-		amount int64
-	}
-	topDonors := make([]donorPair, 0, len(s.donorAmounts))
-	for name, amount := range s.donorAmounts {
-		topDonors = append(topDonors, donorPair{name, amount})
-	}
-	sort.Slice(topDonors, func(i, j int) bool {
-		return topDonors[i].amount > topDonors[j].amount
-	})
-
-	if len(topDonors) > 3 {
-		topDonors = topDonors[:3]
-	}
-
-	fmt.Println(msgDone)
-	fmt.Println()
-	fmt.Printf(msgTotalReceived, formatTHB(s.totalAmount))
-	fmt.Printf(msgSuccessfullyDonated, formatTHB(s.successAmount))
-	fmt.Printf(msgFaultyDonation, formatTHB(faultyAmount))
-	fmt.Println("")
-	fmt.Printf(msgAveragePerPerson, formatTHB(int64(avgPerPerson)))
-	fmt.Print(msgTopDonors)
-
-	if len(topDonors) == 0 {
-		fmt.Println()
-		return
-	}
-
-	for i, donor := range topDonors {
-		if i == 0 {
-			fmt.Printf(" %s\n", donor.name)
-		} else {
-			fmt.Printf("                        %s\n", donor.name)
-		}
+func errorCode(err error) string {
+	var apiErr *APIError
+	var urlErr *url.Error
+	var unconfirmed *UnconfirmedChargeError
+	switch {
+	case errors.As(err, &unconfirmed):
+		return errorCodeChargeUnconfirmed
+	case isRateLimitError(err):
+		return errorCodeRateLimit
+	case errors.As(err, &apiErr) && apiErr.Code != "":
+		return apiErr.Code
+	case errors.As(err, &urlErr):
+		return errorCodeNetwork
 	}
+	return errorCodeUnknown
 }
 
 func isRateLimitError(err error) bool {
 	if err == nil {
 		return false
 	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
 	return strings.Contains(err.Error(), "rate limit")
 }
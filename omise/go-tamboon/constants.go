@@ -0,0 +1,22 @@
+package main
+
+const (
+	liveConfirmation   = "LIVE"
+	chargeConfirmation = "yes"
+
+	msgConfirmCharges  = "charge %d donations? Type %q to continue: "
+	msgApprovalWritten = "approval written to %s, valid until %s\n"
+
+	msgCheckOK     = "  ok    %s\n"
+	msgCheckFailed = "  FAIL  %s: %v\n"
+
+	msgProcessedFile = "%s (run %d as %s, %s)"
+
+	msgLedgerHeader    = "donations in %d\n"
+	msgLedgerEmpty     = "no donations in %d\n"
+	msgLedgerRow       = "  %s  %s  %s  %s\n"
+	msgLedgerName      = "name"
+	msgLedgerAmount    = "amount"
+	msgLedgerDonations = "donations"
+	msgLedgerDonor     = "donor"
+)
@@ -0,0 +1,3 @@
+package display
+
+const zeroWidthSpace = '\u200b'
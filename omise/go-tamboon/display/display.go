@@ -0,0 +1,41 @@
+package display
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/width"
+)
+
+// Width returns the number of terminal columns s occupies. Combining marks,
+// such as Thai vowel and tone marks above or below a consonant, take no
+// column of their own; East Asian wide and fullwidth characters take two.
+func Width(s string) int {
+	w := 0
+	for _, r := range s {
+		w += runeWidth(r)
+	}
+	return w
+}
+
+// PadLeft right-aligns s in a column n cells wide.
+func PadLeft(n int, s string) string {
+	return strings.Repeat(" ", max(n-Width(s), 0)) + s
+}
+
+// PadRight left-aligns s in a column n cells wide.
+func PadRight(n int, s string) string {
+	return s + strings.Repeat(" ", max(n-Width(s), 0))
+}
+
+func runeWidth(r rune) int {
+	switch {
+	case r == zeroWidthSpace, unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf, unicode.Cc):
+		return 0
+	}
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
+}
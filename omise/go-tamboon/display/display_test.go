@@ -0,0 +1,43 @@
+package display
+
+import "testing"
+
+func TestWidth(t *testing.T) {
+	cases := map[string]int{
+		"":               0,
+		"Luke Skywalker": 14,
+		"สมชาย":          5,
+		"สมหญิง ใจดี":    9,
+		"ผู้บริจาคสูงสุด": 10,
+		"山田太郎":     8,
+		"ｆｕｌｌ":     8,
+		"e\u0301":  1,
+		"a\u200bb": 2,
+	}
+
+	for s, expected := range cases {
+		if got := Width(s); got != expected {
+			t.Errorf("Width(%q): expected %d, got %d", s, expected, got)
+		}
+	}
+}
+
+func TestPad(t *testing.T) {
+	cases := []struct {
+		pad      func(int, string) string
+		n        int
+		s        string
+		expected string
+	}{
+		{PadLeft, 8, "mode", "    mode"},
+		{PadLeft, 8, "สมหญิง", "   สมหญิง"},
+		{PadRight, 6, "山田", "山田  "},
+		{PadRight, 2, "too long", "too long"},
+	}
+
+	for _, c := range cases {
+		if got := c.pad(c.n, c.s); got != c.expected {
+			t.Errorf("pad(%d, %q): expected %q, got %q", c.n, c.s, c.expected, got)
+		}
+	}
+}
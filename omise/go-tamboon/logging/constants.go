@@ -0,0 +1,9 @@
+package logging
+
+const (
+	defaultLevel  = "info"
+	defaultFormat = "text"
+	formatJSON    = "json"
+
+	redacted = "[REDACTED]"
+)
@@ -0,0 +1,117 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	panPattern    = regexp.MustCompile(`\b(?:\d[ -]?){8,15}(\d{4})\b`)
+	keyPattern    = regexp.MustCompile(`\b[ps]key_(?:test|live)_[A-Za-z0-9]+`)
+	cvvPattern    = regexp.MustCompile(`(?i)(security[ _]code\]?|cvv|cvc)(["':= ]+)\d{3,4}`)
+	sensitiveKeys = map[string]bool{
+		"cvv": true, "cvc": true, "security_code": true, "card_number": true,
+		"pan": true, "pkey": true, "skey": true, "password": true,
+	}
+)
+
+func InitConfig() {
+	slog.SetDefault(New(os.Stderr, getEnv("LOG_LEVEL", defaultLevel), getEnv("LOG_FORMAT", defaultFormat)))
+}
+
+func New(w io.Writer, level, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: parseLevel(level)}
+
+	var h slog.Handler
+	if strings.EqualFold(format, formatJSON) {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(NewRedactingHandler(h))
+}
+
+// Redact masks card numbers, security codes and Omise keys in s.
+func Redact(s string) string {
+	s = panPattern.ReplaceAllString(s, "****$1")
+	s = keyPattern.ReplaceAllString(s, redacted)
+	s = cvvPattern.ReplaceAllString(s, "$1$2"+redacted)
+	return s
+}
+
+type redactingHandler struct {
+	next slog.Handler
+}
+
+func NewRedactingHandler(next slog.Handler) slog.Handler {
+	return &redactingHandler{next: next}
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redactedAttrs[i] = redactAttr(a)
+	}
+	return &redactingHandler{next: h.next.WithAttrs(redactedAttrs)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(v.String()))
+	case slog.KindGroup:
+		attrs := v.Group()
+		redactedAttrs := make([]any, len(attrs))
+		for i, ga := range attrs {
+			redactedAttrs[i] = redactAttr(ga)
+		}
+		return slog.Group(a.Key, redactedAttrs...)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return slog.String(a.Key, Redact(err.Error()))
+		}
+		return slog.String(a.Key, Redact(v.String()))
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+func parseLevel(level string) slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+func getEnv(key, defaultVal string) string {
+	if val, ok := os.LookupEnv(key); ok && val != "" {
+		return val
+	}
+	return defaultVal
+}
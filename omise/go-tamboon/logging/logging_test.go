@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var cardLike = regexp.MustCompile(`\d(?:[ -]?\d){11,18}`)
+
+func TestRedact(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"card 4242424242424242 declined", "card ****4242 declined"},
+		{"card 4242 4242 4242 4242 declined", "card ****4242 declined"},
+		{"card 4242-4242-4242-4242", "card ****4242"},
+		{"amex 378282246310005", "amex ****0005"},
+		{"auth with skey_test_5abcdef failed", "auth with [REDACTED] failed"},
+		{"card[security_code]=123&card[name]=x", "card[security_code]=[REDACTED]&card[name]=x"},
+		{`{"cvv": "1234"}`, `{"cvv": "[REDACTED]"}`},
+		{"amount 100000 for row 12", "amount 100000 for row 12"},
+	}
+
+	for _, c := range cases {
+		if got := Redact(c.in); got != c.want {
+			t.Errorf("Redact(%q): expected %q, got %q", c.in, c.want, got)
+		}
+	}
+}
+
+func TestRedactingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, "debug", "text")
+
+	logger.With("pkey", "pkey_test_123").Info("tokenizing card 4111111111111111",
+		"row", 3,
+		"cvv", "123",
+		"error", errors.New("API error: invalid card 5555555555554444"),
+		slog.Group("request", "body", "card[number]=4000000000000002&card[security_code]=456"),
+	)
+
+	out := buf.String()
+	if cardLike.MatchString(out) {
+		t.Errorf("Expected no card numbers in log output, got %s", out)
+	}
+	for _, secret := range []string{"pkey_test_123", "=123", "456"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("Expected %q to be redacted, got %s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "row=3") {
+		t.Errorf("Expected non-sensitive fields to be kept, got %s", out)
+	}
+}
+
+func TestNewFormatsAndLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, "warn", "json")
+
+	logger.Info("hidden")
+	logger.Warn("shown", "row", 7)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected only the warning to be logged, got %q", buf.String())
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("Expected JSON output, got %v", err)
+	}
+	if entry["msg"] != "shown" || entry["row"] != float64(7) {
+		t.Errorf("Unexpected entry %v", entry)
+	}
+}
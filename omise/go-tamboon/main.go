@@ -1,37 +1,451 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"flag"
 	"fmt"
+	"go-tamboon/approval"
 	"go-tamboon/client"
+	"go-tamboon/display"
+	"go-tamboon/logging"
+	"go-tamboon/metrics"
+	"go-tamboon/money"
 	"go-tamboon/processor"
-	"log"
+	"go-tamboon/progress"
+	"go-tamboon/store"
+	"go-tamboon/tracing"
+	"io"
+	"log/slog"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 func main() {
 	err := godotenv.Load()
+	logging.InitConfig()
 	if err != nil {
-		log.Printf("Warning: .env file not found, using system environment variables")
+		slog.Warn(".env file not found, using system environment variables")
 	}
 
 	processor.InitConfig()
 	client.InitConfig()
 
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go-tamboon <inputfile.rot128>")
+	live := flag.Bool("live", false, "allow charging real cards with live keys")
+	showProgress := flag.Bool("progress", true, "report progress on stderr while donating")
+	summaryFormat := flag.String("summary", "text", "summary format: text or json")
+	summaryLang := flag.String("lang", "en", "language of the text summary: en or th")
+	summaryTemplate := flag.String("template", "", "text/template file to render the text summary with")
+	reprocess := flag.Bool("reprocess", false, "charge files that an earlier run already processed")
+	yes := flag.Bool("yes", false, "charge without confirming the preview")
+	approvalPath := flag.String("approval", "", "signed approval file that confirms the preview")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: go-tamboon [--live] [--reprocess] [--yes | --approval <approval.json>] <inputfile.rot128|directory|glob>...")
+		fmt.Fprintln(flag.CommandLine.Output(), "       go-tamboon [--live] retry --report <report.json> <inputfile.rot128|directory|glob>...")
+		fmt.Fprintln(flag.CommandLine.Output(), "       go-tamboon [--live] approve [--out <approval.json>] [--valid-for <duration>] <inputfile.rot128|directory|glob>...")
+		fmt.Fprintln(flag.CommandLine.Output(), "       go-tamboon doctor")
+		fmt.Fprintln(flag.CommandLine.Output(), "       go-tamboon ledger [--year <year>] [--donor <name or id>]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		return
+	}
+
+	if flag.Arg(0) == "doctor" {
+		results := client.Preflight()
+		printChecks(os.Stdout, results)
+		if client.PreflightError(results) != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "ledger" {
+		ledgerFlags := flag.NewFlagSet("ledger", flag.ExitOnError)
+		year := ledgerFlags.Int("year", time.Now().Year(), "year to report on")
+		donor := ledgerFlags.String("donor", "", "only report the donor with this name or ID")
+		ledgerFlags.Parse(flag.Args()[1:])
+		if err := printLedger(os.Stdout, *year, *donor, money.LookupLocale(*summaryLang)); err != nil {
+			fatal(err)
+		}
 		return
 	}
 
-	inputPath := os.Args[1]
-	fmt.Println("performing donations...")
+	renderer, err := client.NewRenderer(*summaryFormat, *summaryLang, *summaryTemplate)
+	if err != nil {
+		fatal(err)
+	}
+
+	args := flag.Args()
+	source := client.RecordSource(processor.StreamAndDecryptFile)
+	var previous *client.RunResult
+	var retryIDs map[string]bool
+	var approvalOut string
+	var approvalValidFor time.Duration
+	if flag.Arg(0) == "approve" {
+		approveFlags := flag.NewFlagSet("approve", flag.ExitOnError)
+		out := approveFlags.String("out", "approval.json", "file to write the signed approval to")
+		validFor := approveFlags.Duration("valid-for", 24*time.Hour, "how long the approval stays valid")
+		approveFlags.Parse(flag.Args()[1:])
+		if approveFlags.NArg() < 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		args = approveFlags.Args()
+		approvalOut, approvalValidFor = *out, *validFor
+	} else if flag.Arg(0) == "retry" {
+		retryFlags := flag.NewFlagSet("retry", flag.ExitOnError)
+		reportPath := retryFlags.String("report", "", "JSON summary of the run to retry")
+		retryFlags.Parse(flag.Args()[1:])
+		if *reportPath == "" || retryFlags.NArg() < 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+
+		previous, err = loadReport(*reportPath)
+		if err != nil {
+			fatal(err)
+		}
+		retryIDs = client.RetryableIDs(previous)
+		if len(retryIDs) == 0 {
+			fmt.Fprintln(os.Stderr, "no retryable donations in report")
+			if renderErr := renderer.Render(os.Stdout, previous); renderErr != nil {
+				slog.Error("could not write summary", "error", renderErr)
+			}
+			return
+		}
+		args = retryFlags.Args()
+		source = client.OnlyDonations(source, retryIDs)
+	}
+
+	mode, err := client.CurrentKeyMode()
+	if err != nil {
+		fatal(err)
+	}
+	if mode == client.KeyModeLive && *live {
+		if !confirmLiveMode(os.Stdin, os.Stdout) {
+			fatal(fmt.Errorf("live mode was not confirmed"))
+		}
+		client.EnableLiveMode()
+	}
+
+	omiseClient, err := client.NewOmiseClient()
+	if err != nil {
+		fatal(err)
+	}
+	if err := processor.CheckTransforms(omiseClient.KeyMode()); err != nil {
+		fatal(err)
+	}
+	if previous != nil && previous.Mode != omiseClient.KeyMode() {
+		fatal(fmt.Errorf("report was produced with %s keys, refusing to retry with %s keys", previous.Mode, omiseClient.KeyMode()))
+	}
+
+	if approvalOut != "" {
+		expanded, err := processor.ExpandInputPaths(args)
+		if err != nil {
+			fatal(err)
+		}
+		inputPaths, inputFiles := uniqueInputs(expanded)
+		if previous != nil {
+			if err := client.CheckRetryInputs(previous, fileHashes(inputFiles)); err != nil {
+				fatal(fmt.Errorf("refusing to retry: %w", err))
+			}
+		}
+		preview := omiseClient.Preview(inputPaths, source)
+		if err := client.RenderPreview(os.Stdout, preview, *summaryLang); err != nil {
+			fatal(err)
+		}
+		if preview.Aborted != nil {
+			fatal(fmt.Errorf("malformed row in strict parse mode, not approving: %v", preview.Aborted))
+		}
+		a := approval.New(preview, inputFiles, time.Now(), approvalValidFor)
+		if err := a.Sign([]byte(os.Getenv("APPROVAL_KEY"))); err != nil {
+			fatal(err)
+		}
+		if err := a.Save(approvalOut); err != nil {
+			fatal(err)
+		}
+		fmt.Printf(msgApprovalWritten, approvalOut, a.Expires.Local().Format(time.DateTime))
+		return
+	}
+
+	results := client.Preflight()
+	if err := client.PreflightError(results); err != nil {
+		printChecks(os.Stderr, results)
+		fatal(err)
+	}
+
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		listenAddr, err := metrics.Serve(addr)
+		if err != nil {
+			fatal(fmt.Errorf("starting metrics endpoint: %v", err))
+		}
+		slog.Info("serving metrics", "addr", listenAddr.String())
+	}
+
+	expanded, err := processor.ExpandInputPaths(args)
+	if err != nil {
+		fatal(err)
+	}
+	inputPaths, inputFiles := uniqueInputs(expanded)
+	if previous != nil {
+		if err := client.CheckRetryInputs(previous, fileHashes(inputFiles)); err != nil {
+			fatal(fmt.Errorf("refusing to retry: %w", err))
+		}
+	}
+
+	var history *store.Store
+	if path := os.Getenv("HISTORY_DB"); path != "" {
+		history, err = store.Open(path)
+		if err != nil {
+			fatal(err)
+		}
+		defer history.Close()
+		if previous == nil && !*reprocess {
+			if err := checkProcessedFiles(history, inputFiles, omiseClient.KeyMode()); err != nil {
+				fatal(err)
+			}
+		}
+		omiseClient.SetChargeHistory(history)
+	} else if previous == nil && !*reprocess {
+		fatal(fmt.Errorf("HISTORY_DB is not set, so input files cannot be checked against earlier runs; set it, or pass --reprocess to charge without the check"))
+	} else {
+		slog.Warn("HISTORY_DB is not set, input files and rows are not checked against earlier runs")
+	}
+
+	preview := omiseClient.Preview(inputPaths, source)
+	if err := client.RenderPreview(os.Stderr, preview, *summaryLang); err != nil {
+		fatal(err)
+	}
+	if preview.Aborted != nil {
+		fatal(fmt.Errorf("malformed row in strict parse mode, nothing was charged: %v", preview.Aborted))
+	}
+	if err := confirmRun(os.Stdin, preview, inputFiles, *approvalPath, *yes); err != nil {
+		fatal(err)
+	}
+	var runID int64
+	if history != nil {
+		runID, err = history.StartRun(omiseClient.KeyMode(), preview.Currency, time.Now(), inputFiles)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "performing donations in %s mode...\n", strings.ToUpper(string(omiseClient.KeyMode())))
+
+	shutdownTracing, err := tracing.InitConfig(context.Background())
+	if err != nil {
+		fatal(fmt.Errorf("starting tracing: %v", err))
+	}
+
+	if *showProgress {
+		reporter := progress.New(os.Stderr)
+		if retryIDs != nil {
+			reporter.AddTotal(int64(len(retryIDs)))
+		} else {
+			for _, path := range inputPaths {
+				if rows, err := processor.CountRows(path); err == nil {
+					reporter.AddTotal(int64(rows))
+				}
+			}
+		}
+		omiseClient.SetProgress(reporter)
+		reporter.Start()
+		defer reporter.Stop()
+	}
+
+	var quarantine *processor.QuarantineWriter
+	if dir := os.Getenv("QUARANTINE_DIR"); dir != "" {
+		quarantine = processor.NewQuarantineWriter(dir)
+		omiseClient.SetQuarantine(quarantine)
+	}
+
+	result, err := omiseClient.ProcessDonationFiles(inputPaths, source)
+	result.SetFileHashes(fileHashes(inputFiles))
+	if shutdownErr := shutdownTracing(context.Background()); shutdownErr != nil {
+		slog.Warn("could not flush traces", "error", shutdownErr)
+	}
+	if quarantine != nil {
+		if closeErr := quarantine.Close(); closeErr != nil {
+			slog.Error("could not write quarantine files", "error", closeErr)
+		}
+		for _, f := range quarantine.Files() {
+			slog.Info("quarantined rows", "file", f.Path, "rows", f.Rows, "retryable", f.Retryable)
+		}
+	}
+	if history != nil {
+		if saveErr := history.FinishRun(runID, result, inputFiles); saveErr != nil {
+			slog.Error("could not save run history", "error", saveErr)
+		} else {
+			slog.Info("saved run history", "run", runID)
+		}
+	}
+	if previous != nil {
+		result = client.MergeRetry(previous, result)
+	}
+	if renderErr := renderer.Render(os.Stdout, result); renderErr != nil {
+		slog.Error("could not write summary", "error", renderErr)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
 
-	recordCh, err := processor.StreamAndDecryptFile(inputPath)
+func loadReport(path string) (*client.RunResult, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("opening report: %v", err)
 	}
+	defer f.Close()
+	return client.LoadRunResult(f)
+}
+
+// checkProcessedFiles refuses files whose contents an earlier run with the
+// same key mode already charged, so a file is not charged twice by mistake.
+func checkProcessedFiles(history *store.Store, files []processor.InputFile, mode client.KeyMode) error {
+	var processed []string
+	for _, f := range files {
+		runs, err := history.FileRuns(f.SHA256, mode)
+		if err != nil {
+			return err
+		}
+		if len(runs) > 0 {
+			processed = append(processed, fmt.Sprintf(msgProcessedFile, f.Path, runs[0].RunID, runs[0].Path,
+				runs[0].Finished.Local().Format(time.DateTime)))
+		}
+	}
+	if len(processed) > 0 {
+		return fmt.Errorf("already processed, pass --reprocess to charge again: %s", strings.Join(processed, "; "))
+	}
+	return nil
+}
+
+// printLedger writes what each donor gave in year, from the database in
+// HISTORY_DB, with the columns aligned by display width.
+func printLedger(w io.Writer, year int, donor string, locale money.Locale) error {
+	path := os.Getenv("HISTORY_DB")
+	if path == "" {
+		return fmt.Errorf("HISTORY_DB is not set")
+	}
+	history, err := store.Open(path)
+	if err != nil {
+		return err
+	}
+	defer history.Close()
+
+	var entries []store.LedgerEntry
+	if donor != "" {
+		entries, err = history.DonorYear(donor, year)
+	} else {
+		entries, err = history.YearEndReport(year)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Fprintf(w, msgLedgerEmpty, year)
+		return nil
+	}
+
+	nameWidth, amountWidth := display.Width(msgLedgerName), 0
+	for _, e := range entries {
+		nameWidth = max(nameWidth, display.Width(e.Name))
+		amountWidth = max(amountWidth, display.Width(e.Amount.Format(locale)))
+	}
+	fmt.Fprintf(w, msgLedgerHeader, year)
+	fmt.Fprintf(w, msgLedgerRow, display.PadRight(nameWidth, msgLedgerName),
+		display.PadRight(amountWidth+4, msgLedgerAmount), msgLedgerDonations, msgLedgerDonor)
+	for _, e := range entries {
+		amount := e.Amount.Currency + " " + display.PadLeft(amountWidth, e.Amount.Format(locale))
+		fmt.Fprintf(w, msgLedgerRow, display.PadRight(nameWidth, e.Name), amount,
+			display.PadLeft(display.Width(msgLedgerDonations), fmt.Sprint(e.Donations)), e.DonorID)
+	}
+	return nil
+}
+
+// uniqueInputs hashes the input files and drops any whose contents repeat
+// an earlier one, so a file passed twice is only charged once. Files that
+// cannot be read are kept without a fingerprint; the run reports them.
+func uniqueInputs(paths []string) ([]string, []processor.InputFile) {
+	var unique []string
+	var files []processor.InputFile
+	seen := make(map[string]string)
+	for _, p := range paths {
+		f, err := processor.Fingerprint(p)
+		if err != nil {
+			unique = append(unique, p)
+			continue
+		}
+		if first, ok := seen[f.SHA256]; ok {
+			slog.Warn("skipping repeated input file", "file", p, "same_as", first)
+			continue
+		}
+		seen[f.SHA256] = p
+		unique = append(unique, p)
+		files = append(files, f)
+	}
+	return unique, files
+}
+
+// fileHashes maps each fingerprinted input file to its SHA-256.
+func fileHashes(files []processor.InputFile) map[string]string {
+	hashes := make(map[string]string, len(files))
+	for _, f := range files {
+		hashes[f.Path] = f.SHA256
+	}
+	return hashes
+}
+
+// confirmRun decides whether the previewed donations may be charged: by a
+// signed approval, by --yes, or by asking on in when it is a terminal.
+func confirmRun(in *os.File, preview *client.Preview, files []processor.InputFile, approvalPath string, yes bool) error {
+	switch {
+	case preview.Donations == 0:
+		return nil
+	case approvalPath != "":
+		a, err := approval.Load(approvalPath)
+		if err != nil {
+			return err
+		}
+		return a.Check([]byte(os.Getenv("APPROVAL_KEY")), preview, files, time.Now())
+	case yes:
+		return nil
+	case !progress.IsTerminal(in):
+		return fmt.Errorf("charges were not confirmed, pass --yes or --approval when not running interactively")
+	case !confirmCharges(in, os.Stderr, preview):
+		return fmt.Errorf("charges were not confirmed")
+	}
+	return nil
+}
+
+func confirmCharges(in io.Reader, out io.Writer, preview *client.Preview) bool {
+	fmt.Fprintf(out, msgConfirmCharges, preview.Donations, chargeConfirmation)
+	line, _ := bufio.NewReader(in).ReadString('\n')
+	return strings.TrimSpace(line) == chargeConfirmation
+}
+
+func confirmLiveMode(in io.Reader, out io.Writer) bool {
+	fmt.Fprintf(out, "LIVE keys detected, real cards will be charged. Type %q to continue: ", liveConfirmation)
+	line, _ := bufio.NewReader(in).ReadString('\n')
+	return strings.TrimSpace(line) == liveConfirmation
+}
+
+func printChecks(w io.Writer, results []client.CheckResult) {
+	for _, r := range results {
+		if r.OK() {
+			fmt.Fprintf(w, msgCheckOK, r.Name)
+		} else {
+			fmt.Fprintf(w, msgCheckFailed, r.Name, r.Err)
+		}
+	}
+}
 
-	omiseClient := client.NewOmiseClient()
-	omiseClient.ProcessDonationsStream(recordCh)
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
 }
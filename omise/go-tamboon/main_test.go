@@ -3,10 +3,15 @@ package main
 import (
 	"go-tamboon/cipher"
 	"go-tamboon/client"
+	"go-tamboon/money"
 	"go-tamboon/processor"
+	"go-tamboon/store"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMainWorkflow(t *testing.T) {
@@ -21,9 +26,9 @@ func TestMainWorkflow(t *testing.T) {
 		t.Fatalf("StreamAndDecryptFile failed: %v", err)
 	}
 
-	omiseClient := client.NewOmiseClient()
-	if omiseClient == nil {
-		t.Error("Expected omise client to be created")
+	omiseClient, err := client.NewOmiseClient()
+	if err != nil || omiseClient == nil {
+		t.Errorf("Expected omise client to be created, got %v", err)
 	}
 
 	var recordCount int
@@ -32,7 +37,7 @@ func TestMainWorkflow(t *testing.T) {
 		if record.Name == "" {
 			t.Error("Expected non-empty name")
 		}
-		if record.AmountSubunits == "" {
+		if record.Amount.Subunits == 0 {
 			t.Error("Expected non-empty amount")
 		}
 	}
@@ -73,6 +78,92 @@ func TestMainWorkflowInvalidFile(t *testing.T) {
 	}
 }
 
+func TestConfirmLiveMode(t *testing.T) {
+	cases := map[string]bool{
+		"LIVE\n": true,
+		"LIVE":   true,
+		"live\n": false,
+		"yes\n":  false,
+		"":       false,
+	}
+
+	for input, want := range cases {
+		var out strings.Builder
+		if got := confirmLiveMode(strings.NewReader(input), &out); got != want {
+			t.Errorf("confirmLiveMode(%q): expected %v, got %v", input, want, got)
+		}
+		if !strings.Contains(out.String(), "LIVE keys detected") {
+			t.Errorf("Expected a warning prompt, got %q", out.String())
+		}
+	}
+}
+
+func TestConfirmCharges(t *testing.T) {
+	cases := map[string]bool{
+		"yes\n":    true,
+		"  yes \n": true,
+		"y\n":      false,
+		"YES\n":    false,
+		"":         false,
+	}
+
+	preview := &client.Preview{Donations: 3}
+	for input, want := range cases {
+		var out strings.Builder
+		if got := confirmCharges(strings.NewReader(input), &out, preview); got != want {
+			t.Errorf("confirmCharges(%q): expected %v, got %v", input, want, got)
+		}
+		if !strings.Contains(out.String(), "charge 3 donations?") {
+			t.Errorf("Expected a prompt with the donation count, got %q", out.String())
+		}
+	}
+}
+
+func TestConfirmRunWithoutTerminal(t *testing.T) {
+	stdin, err := os.Create(filepath.Join(t.TempDir(), "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+
+	preview := &client.Preview{Donations: 1}
+	if err := confirmRun(stdin, &client.Preview{}, nil, "", false); err != nil {
+		t.Errorf("Expected nothing to confirm without donations, got %v", err)
+	}
+	if err := confirmRun(stdin, preview, nil, "", true); err != nil {
+		t.Errorf("Expected --yes to confirm, got %v", err)
+	}
+	if err := confirmRun(stdin, preview, nil, "", false); err == nil || !strings.Contains(err.Error(), "--yes or --approval") {
+		t.Errorf("Expected unattended runs to need --yes or --approval, got %v", err)
+	}
+	if err := confirmRun(stdin, preview, nil, filepath.Join(t.TempDir(), "missing.json"), false); err == nil {
+		t.Error("Expected a missing approval file to be refused")
+	}
+}
+
+func TestUniqueInputs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a := write("a.rot128", "same")
+	copied := write("copy.rot128", "same")
+	b := write("b.rot128", "other")
+	missing := filepath.Join(dir, "missing.rot128")
+
+	paths, files := uniqueInputs([]string{a, missing, copied, b, a})
+	if want := []string{a, missing, b}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("Expected %v, got %v", want, paths)
+	}
+	if len(files) != 2 || files[0].Path != a || files[1].Path != b {
+		t.Errorf("Expected fingerprints of a and b only, got %+v", files)
+	}
+}
+
 func createTestROT128File(t *testing.T, data string) string {
 	tempFile := createTempFile(t, "test.rot128", "")
 
@@ -113,3 +204,69 @@ func createFileWriter(t *testing.T, filename string) *os.File {
 	}
 	return file
 }
+
+func TestPrintLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	t.Setenv("HISTORY_DB", path)
+
+	history, err := store.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finished := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	result := &client.RunResult{Currency: "THB", Finished: finished, Summary: client.Summary{Outcomes: []client.DonationOutcome{
+		{ID: "a", DonorID: "card:fp1", Name: "สมชาย", Amount: money.New(123456, "THB"), Outcome: client.OutcomeSucceeded},
+		{ID: "b", DonorID: "card:fp2", Name: "Jane Doe", Amount: money.New(500, "THB"), Outcome: client.OutcomeSucceeded},
+	}}}
+	if _, err := history.SaveRun(result, nil); err != nil {
+		t.Fatal(err)
+	}
+	history.Close()
+
+	var out strings.Builder
+	if err := printLedger(&out, 2026, "", money.LocaleEN); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := "donations in 2026\n" +
+		"  name      amount        donations  donor\n" +
+		"  สมชาย     THB 1,234.56          1  card:fp1\n" +
+		"  Jane Doe  THB     5.00          1  card:fp2\n"
+	if out.String() != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, out.String())
+	}
+
+	out.Reset()
+	if err := printLedger(&out, 2025, "", money.LocaleEN); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if out.String() != "no donations in 2025\n" {
+		t.Errorf("Expected empty ledger, got %q", out.String())
+	}
+}
+
+func TestCheckProcessedFiles(t *testing.T) {
+	history, err := store.Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+
+	done := processor.InputFile{Path: "old/a.rot128", SHA256: "abc123", Size: 3}
+	result := &client.RunResult{Mode: client.KeyModeTest, Finished: time.Now(), Files: []client.FileResult{{Path: done.Path}}}
+	if _, err := history.SaveRun(result, []processor.InputFile{done}); err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := processor.InputFile{Path: "new/a.rot128", SHA256: "abc123", Size: 3}
+	fresh := processor.InputFile{Path: "b.rot128", SHA256: "def456", Size: 3}
+	err = checkProcessedFiles(history, []processor.InputFile{fresh, renamed}, client.KeyModeTest)
+	if err == nil || !strings.Contains(err.Error(), "new/a.rot128 (run 1 as old/a.rot128") {
+		t.Errorf("Expected the renamed copy to be refused, got %v", err)
+	}
+	if err := checkProcessedFiles(history, []processor.InputFile{renamed}, client.KeyModeLive); err != nil {
+		t.Errorf("Expected a test run not to block live keys, got %v", err)
+	}
+	if err := checkProcessedFiles(history, []processor.InputFile{fresh}, client.KeyModeTest); err != nil {
+		t.Errorf("Expected a new file to pass, got %v", err)
+	}
+}
@@ -0,0 +1,12 @@
+package metrics
+
+import "time"
+
+const (
+	namespace         = "tamboon"
+	metricsPath       = "/metrics"
+	readHeaderTimeout = 5 * time.Second
+
+	EndpointToken  = "token"
+	EndpointCharge = "charge"
+)
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	RowsRead = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rows_read_total",
+		Help:      "Donation rows read from input files, including rejected rows.",
+	})
+	RowsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rows_rejected_total",
+		Help:      "Rows rejected before reaching Omise, by reason.",
+	}, []string{"reason"})
+	TokensCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_created_total",
+		Help:      "Card tokens created.",
+	})
+	ChargesSucceeded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "charges_succeeded_total",
+		Help:      "Charges created successfully.",
+	})
+	ChargesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "charges_failed_total",
+		Help:      "Donations that failed during tokenization or charging, by error code.",
+	}, []string{"code"})
+	DuplicateDonations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "duplicate_donations_total",
+		Help:      "Donations repeating an earlier one's card, amount and name, by DUPLICATE_ROWS policy.",
+	}, []string{"policy"})
+	Retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_total",
+		Help:      "Requests retried after a rate limit response, by endpoint.",
+	}, []string{"endpoint"})
+	RateLimitPauseSeconds = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limiter_pause_seconds_total",
+		Help:      "Time all workers spent paused by the rate limiter.",
+	})
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of Omise API requests, by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+	WorkersInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "workers_in_flight",
+		Help:      "Donations currently being tokenized or charged, by endpoint.",
+	}, []string{"endpoint"})
+	ConcurrencyLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "concurrency_limit",
+		Help:      "Requests each pipeline stage may have in flight, by endpoint.",
+	}, []string{"endpoint"})
+)
+
+func init() {
+	registry.MustRegister(
+		RowsRead, RowsRejected, TokensCreated, ChargesSucceeded, ChargesFailed, DuplicateDonations,
+		Retries, RateLimitPauseSeconds, RequestDuration, WorkersInFlight, ConcurrencyLimit,
+	)
+}
+
+func ObserveRequest(endpoint string, start time.Time) {
+	RequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Serve exposes the metrics on addr until the process exits.
+func Serve(addr string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: readHeaderTimeout}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server stopped", "error", err)
+		}
+	}()
+	return listener.Addr(), nil
+}
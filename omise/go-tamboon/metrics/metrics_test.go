@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	addr, err := Serve("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	RowsRead.Add(3)
+	ChargesFailed.WithLabelValues("invalid_card").Inc()
+	Retries.WithLabelValues(EndpointToken).Inc()
+	ObserveRequest(EndpointCharge, time.Now().Add(-50*time.Millisecond))
+	WorkersInFlight.WithLabelValues(EndpointCharge).Set(2)
+
+	resp, err := http.Get("http://" + addr.String() + metricsPath)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	out := string(body)
+
+	for _, expect := range []string{
+		"tamboon_rows_read_total 3",
+		`tamboon_charges_failed_total{code="invalid_card"} 1`,
+		`tamboon_retries_total{endpoint="token"} 1`,
+		`tamboon_request_duration_seconds_count{endpoint="charge"} 1`,
+		`tamboon_workers_in_flight{endpoint="charge"} 2`,
+		"tamboon_rate_limiter_pause_seconds_total 0",
+	} {
+		if !strings.Contains(out, expect) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", expect, out)
+		}
+	}
+}
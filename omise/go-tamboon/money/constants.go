@@ -0,0 +1,31 @@
+package money
+
+const defaultExponent = 2
+
+// exponents lists the currencies whose minor unit is not 1/100, following
+// ISO 4217. Every other currency uses two decimal places.
+var exponents = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"VND": 0,
+	"IDR": 0,
+	"BHD": 3,
+	"JOD": 3,
+	"KWD": 3,
+	"OMR": 3,
+	"TND": 3,
+}
+
+var (
+	LocaleEN = Locale{Group: ",", Decimal: "."}
+	LocaleTH = Locale{Group: ",", Decimal: "."}
+	LocaleDE = Locale{Group: ".", Decimal: ","}
+	LocaleFR = Locale{Group: "\u202f", Decimal: ","}
+)
+
+var locales = map[string]Locale{
+	"en": LocaleEN,
+	"th": LocaleTH,
+	"de": LocaleDE,
+	"fr": LocaleFR,
+}
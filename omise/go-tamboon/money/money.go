@@ -0,0 +1,164 @@
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrOverflow         = errors.New("amount overflows")
+	ErrCurrencyMismatch = errors.New("amounts are in different currencies")
+)
+
+// Amount is an exact amount of money in the minor unit of its currency,
+// e.g. satang for THB. An Amount with no currency is zero in any currency.
+type Amount struct {
+	Subunits int64  `json:"subunits"`
+	Currency string `json:"currency"`
+}
+
+// Locale holds the separators used to format amounts.
+type Locale struct {
+	Group   string
+	Decimal string
+}
+
+func New(subunits int64, currency string) Amount {
+	return Amount{Subunits: subunits, Currency: strings.ToUpper(currency)}
+}
+
+// Exponent returns the number of decimal places in currency's minor unit.
+func Exponent(currency string) int {
+	if exp, ok := exponents[strings.ToUpper(currency)]; ok {
+		return exp
+	}
+	return defaultExponent
+}
+
+// LookupLocale returns the separators for a language tag such as "th" or
+// "de-CH", falling back to English.
+func LookupLocale(tag string) Locale {
+	lang, _, _ := strings.Cut(strings.ToLower(tag), "-")
+	lang, _, _ = strings.Cut(lang, "_")
+	if l, ok := locales[lang]; ok {
+		return l
+	}
+	return LocaleEN
+}
+
+func (a Amount) IsZero() bool {
+	return a.Subunits == 0
+}
+
+func (a Amount) Add(b Amount) (Amount, error) {
+	currency, err := commonCurrency(a, b)
+	if err != nil {
+		return Amount{}, err
+	}
+	if (b.Subunits > 0 && a.Subunits > math.MaxInt64-b.Subunits) ||
+		(b.Subunits < 0 && a.Subunits < math.MinInt64-b.Subunits) {
+		return Amount{}, fmt.Errorf("%w: %d + %d", ErrOverflow, a.Subunits, b.Subunits)
+	}
+	return Amount{Subunits: a.Subunits + b.Subunits, Currency: currency}, nil
+}
+
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if b.Subunits == math.MinInt64 {
+		return Amount{}, fmt.Errorf("%w: %d - %d", ErrOverflow, a.Subunits, b.Subunits)
+	}
+	return a.Add(Amount{Subunits: -b.Subunits, Currency: b.Currency})
+}
+
+// Mul multiplies a by num/den, rounding half away from zero.
+func (a Amount) Mul(num, den int64) (Amount, error) {
+	if den == 0 {
+		return Amount{}, fmt.Errorf("division by zero")
+	}
+	product := new(big.Int).Mul(big.NewInt(a.Subunits), big.NewInt(num))
+	quotient, ok := divRound(product, big.NewInt(den))
+	if !ok {
+		return Amount{}, fmt.Errorf("%w: %d * %d/%d", ErrOverflow, a.Subunits, num, den)
+	}
+	return Amount{Subunits: quotient, Currency: a.Currency}, nil
+}
+
+// Div splits a into n equal parts, rounding half away from zero. Dividing
+// by zero returns zero so averages over no donations stay well defined.
+func (a Amount) Div(n int64) Amount {
+	if n == 0 {
+		return Amount{Currency: a.Currency}
+	}
+	quotient, _ := divRound(big.NewInt(a.Subunits), big.NewInt(n))
+	return Amount{Subunits: quotient, Currency: a.Currency}
+}
+
+// Format writes the amount in major units with the currency's number of
+// decimal places, grouping thousands, e.g. "1,234.56".
+func (a Amount) Format(l Locale) string {
+	digits := new(big.Int).Abs(big.NewInt(a.Subunits)).String()
+	exp := Exponent(a.Currency)
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	whole, fraction := digits[:len(digits)-exp], digits[len(digits)-exp:]
+
+	var b strings.Builder
+	if a.Subunits < 0 {
+		b.WriteByte('-')
+	}
+	for i := range len(whole) {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(l.Group)
+		}
+		b.WriteByte(whole[i])
+	}
+	if exp > 0 {
+		b.WriteString(l.Decimal)
+		b.WriteString(fraction)
+	}
+	return b.String()
+}
+
+func (a Amount) String() string {
+	if a.Currency == "" {
+		return a.Format(LocaleEN)
+	}
+	return a.Currency + " " + a.Format(LocaleEN)
+}
+
+// SubunitString returns the amount as an integer in minor units, the way
+// payment APIs expect it.
+func (a Amount) SubunitString() string {
+	return strconv.FormatInt(a.Subunits, 10)
+}
+
+func commonCurrency(a, b Amount) (string, error) {
+	switch {
+	case a.Currency == "":
+		return b.Currency, nil
+	case b.Currency == "" || strings.EqualFold(a.Currency, b.Currency):
+		return a.Currency, nil
+	}
+	return "", fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, a.Currency, b.Currency)
+}
+
+func divRound(n, d *big.Int) (int64, bool) {
+	quotient, remainder := new(big.Int).QuoRem(n, d, new(big.Int))
+	twice := new(big.Int).Abs(remainder)
+	twice.Lsh(twice, 1)
+	if twice.Cmp(new(big.Int).Abs(d)) >= 0 {
+		if (n.Sign() < 0) != (d.Sign() < 0) {
+			quotient.Sub(quotient, big.NewInt(1))
+		} else {
+			quotient.Add(quotient, big.NewInt(1))
+		}
+	}
+	if !quotient.IsInt64() {
+		return 0, false
+	}
+	return quotient.Int64(), true
+}
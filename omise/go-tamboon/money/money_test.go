@@ -0,0 +1,111 @@
+package money
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	cases := []struct {
+		amount   Amount
+		locale   Locale
+		expected string
+	}{
+		{New(0, "THB"), LocaleEN, "0.00"},
+		{New(5, "THB"), LocaleEN, "0.05"},
+		{New(123456, "THB"), LocaleEN, "1,234.56"},
+		{New(-123456, "THB"), LocaleEN, "-1,234.56"},
+		{New(21000000, "thb"), LocaleTH, "210,000.00"},
+		{New(123456, "THB"), LocaleDE, "1.234,56"},
+		{New(123456, "EUR"), LocaleFR, "1\u202f234,56"},
+		{New(1234567, "JPY"), LocaleEN, "1,234,567"},
+		{New(1234567, "KWD"), LocaleEN, "1,234.567"},
+		// float64 cannot represent every subunit of amounts this large.
+		{New(math.MaxInt64, "THB"), LocaleEN, "92,233,720,368,547,758.07"},
+		{New(math.MinInt64, "THB"), LocaleEN, "-92,233,720,368,547,758.08"},
+	}
+
+	for _, c := range cases {
+		if got := c.amount.Format(c.locale); got != c.expected {
+			t.Errorf("Format(%d %s): expected %q, got %q", c.amount.Subunits, c.amount.Currency, c.expected, got)
+		}
+	}
+	if got := New(123456, "THB").String(); got != "THB 1,234.56" {
+		t.Errorf("Expected THB 1,234.56, got %q", got)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	cases := []struct {
+		a, b     Amount
+		expected Amount
+		err      error
+	}{
+		{New(100, "THB"), New(250, "THB"), New(350, "THB"), nil},
+		{Amount{}, New(250, "THB"), New(250, "THB"), nil},
+		{New(100, "THB"), New(-250, "THB"), New(-150, "THB"), nil},
+		{New(math.MaxInt64, "THB"), New(1, "THB"), Amount{}, ErrOverflow},
+		{New(math.MinInt64, "THB"), New(-1, "THB"), Amount{}, ErrOverflow},
+		{New(100, "THB"), New(100, "JPY"), Amount{}, ErrCurrencyMismatch},
+	}
+
+	for _, c := range cases {
+		got, err := c.a.Add(c.b)
+		if !errors.Is(err, c.err) || got != c.expected {
+			t.Errorf("%v + %v: expected %v (%v), got %v (%v)", c.a, c.b, c.expected, c.err, got, err)
+		}
+	}
+
+	if _, err := New(0, "THB").Sub(New(math.MinInt64, "THB")); !errors.Is(err, ErrOverflow) {
+		t.Errorf("Expected negating the smallest amount to overflow, got %v", err)
+	}
+}
+
+func TestMulAndDiv(t *testing.T) {
+	cases := []struct {
+		subunits, num, den int64
+		expected           int64
+	}{
+		{5000, 1, 100, 50},
+		{5000, 3, 8, 1875},
+		{1, 3, 4, 1},
+		{1, 1, 3, 0},
+		{5, 1, 2, 3},
+		{-5, 1, 2, -3},
+		{math.MaxInt64, 2, 2, math.MaxInt64},
+	}
+
+	for _, c := range cases {
+		got, err := New(c.subunits, "THB").Mul(c.num, c.den)
+		if err != nil || got.Subunits != c.expected {
+			t.Errorf("%d * %d/%d: expected %d, got %d (%v)", c.subunits, c.num, c.den, c.expected, got.Subunits, err)
+		}
+	}
+
+	if _, err := New(math.MaxInt64, "THB").Mul(2, 1); !errors.Is(err, ErrOverflow) {
+		t.Errorf("Expected doubling the largest amount to overflow, got %v", err)
+	}
+	if got := New(1000, "THB").Div(3); got != New(333, "THB") {
+		t.Errorf("Expected 1000/3 to round to 333, got %v", got)
+	}
+	if got := New(1000, "THB").Div(0); got != New(0, "THB") {
+		t.Errorf("Expected dividing by zero to return zero, got %v", got)
+	}
+}
+
+func TestLookupLocale(t *testing.T) {
+	cases := map[string]Locale{
+		"th":    LocaleTH,
+		"de-CH": LocaleDE,
+		"fr_FR": LocaleFR,
+		"":      LocaleEN,
+		"xx":    LocaleEN,
+	}
+
+	for tag, expected := range cases {
+		if got := LookupLocale(tag); got != expected {
+			t.Errorf("LookupLocale(%q): expected %+v, got %+v", tag, expected, got)
+		}
+	}
+}
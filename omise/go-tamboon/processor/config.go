@@ -1,18 +1,47 @@
 package processor
 
 import (
+	"fmt"
+	"go-tamboon/client"
 	"os"
 	"strconv"
 )
 
 var (
-	maxRecords      = defaultMaxRecords
-	expYearIncrease = defaultExpYearIncrease
+	maxRecords    = defaultMaxRecords
+	parseMode     = defaultParseMode
+	transformSpec = ""
 )
 
 func InitConfig() {
 	maxRecords = getEnvInt("MAX_RECORDS", defaultMaxRecords)
-	expYearIncrease = getEnvInt("EXP_YEAR_INCREASE", defaultExpYearIncrease)
+	parseMode = getEnvString("PARSE_MODE", defaultParseMode)
+	transformSpec = getEnvString("ROW_TRANSFORMS", "")
+
+	// EXP_YEAR_INCREASE predates ROW_TRANSFORMS and is kept as a shorthand.
+	if years := getEnvInt("EXP_YEAR_INCREASE", 0); years != 0 {
+		transformSpec = fmt.Sprintf("shift_expiry=%d%s%s", years, transformSeparator, transformSpec)
+	}
+}
+
+// CheckTransforms reports whether ROW_TRANSFORMS can be used with mode keys,
+// so that a bad spec stops the run before any file is read.
+func CheckTransforms(mode client.KeyMode) error {
+	transforms, err := parseTransforms(transformSpec)
+	if err != nil {
+		return err
+	}
+	if len(transforms) > 0 && mode == client.KeyModeLive {
+		return fmt.Errorf("row transforms are test-only and cannot be used with live keys")
+	}
+	return nil
+}
+
+func loadTransforms() ([]rowTransform, error) {
+	if err := CheckTransforms(client.ClassifyKey(os.Getenv("OMISE_SKEY"))); err != nil {
+		return nil, err
+	}
+	return parseTransforms(transformSpec)
 }
 
 func getEnvInt(key string, defaultVal int) int {
@@ -23,3 +52,10 @@ func getEnvInt(key string, defaultVal int) int {
 	}
 	return defaultVal
 }
+
+func getEnvString(key string, defaultVal string) string {
+	if val, ok := os.LookupEnv(key); ok && val != "" {
+		return val
+	}
+	return defaultVal
+}
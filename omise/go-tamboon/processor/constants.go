@@ -1,8 +1,24 @@
 package processor
 
 const (
-	defaultMaxRecords      = 5
-	defaultExpYearIncrease = 5
+	defaultMaxRecords = 5
+
+	inputFileExtension = ".rot128"
+
+	parseModeLenient = "lenient"
+	parseModeStrict  = "strict"
+	defaultParseMode = parseModeLenient
+
+	minFields      = 6
+	fieldSeparator = ","
+
+	quarantineHeader      = "Name,AmountSubunits,CCNumber,CVV,ExpMonth,ExpYear,FailureReason"
+	quarantineRetryable   = "retryable"
+	quarantinePermanent   = "permanent"
+	quarantineStampFormat = "20060102-150405.000"
+
+	transformSeparator = ";"
+	defaultTestCard    = "4242424242424242"
 
 	colName           = 0
 	colAmountSubunits = 1
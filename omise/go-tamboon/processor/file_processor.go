@@ -2,11 +2,14 @@ package processor
 
 import (
 	"bufio"
+	"fmt"
 	"go-tamboon/cipher"
 	"go-tamboon/client"
+	"go-tamboon/metrics"
+	"log/slog"
 	"os"
-	"strconv"
 	"strings"
+	"time"
 )
 
 func StreamAndDecryptFile(inputPath string) (<-chan client.DonationRecord, error) {
@@ -25,45 +28,125 @@ func StreamAndDecryptFile(inputPath string) (<-chan client.DonationRecord, error
 		return out, err
 	}
 
+	transforms, err := loadTransforms()
+	if err != nil {
+		inFile.Close()
+		close(out)
+		return out, err
+	}
+
+	strict := parseMode == parseModeStrict
+	slog.Debug("reading donation file", "file", inputPath, "parse_mode", parseMode, "transforms", len(transforms))
+
 	go func() {
 		defer inFile.Close()
 		defer close(out)
 		scanner := bufio.NewScanner(reader)
-		first := true
+		lineNo := 0
 		count := 0
 		for scanner.Scan() {
 			if maxRecords > 0 && count >= maxRecords {
-				break
+				return
 			}
+			lineNo++
 			line := scanner.Text()
-			if first {
-				first = false
+			if lineNo == 1 || line == "" {
 				continue
 			}
-			if line == "" {
-				continue
+
+			metrics.RowsRead.Inc()
+			parseStarted := time.Now()
+			fields := strings.Split(line, fieldSeparator)
+			record, rowErr := parseRow(fields)
+			if rowErr == nil {
+				rowErr = applyTransforms(&record, transforms)
 			}
-			row := strings.Split(line, ",")
-			if len(row) >= 6 {
-				// TODO: Add ExpYearIncrease years to expYear to make some expired cards in test data will pass
-				expYearStr := strings.TrimSpace(row[colExpYear])
-				expYear, err := strconv.Atoi(expYearStr)
-				if err != nil {
-					expYear = 0
-				}
-				expYear += expYearIncrease
-				record := client.DonationRecord{
-					Name:           strings.TrimSpace(row[colName]),
-					AmountSubunits: strings.TrimSpace(row[colAmountSubunits]),
-					CCNumber:       strings.TrimSpace(row[colCCNumber]),
-					CVV:            strings.TrimSpace(row[colCVV]),
-					ExpMonth:       strings.TrimSpace(row[colExpMonth]),
-					ExpYear:        strconv.Itoa(expYear),
-				}
+			record.Source = inputPath
+			record.Line = lineNo
+			record.Row = client.NewRawRow(fields)
+			record.ParseStarted = parseStarted
+			record.ParseFinished = time.Now()
+			if rowErr != nil {
+				rowErr.Line = lineNo
+				rowErr.FieldCount = len(fields)
+				rowErr.Abort = strict
+				record.Reject = rowErr
 				out <- record
-				count++
+				if strict {
+					return
+				}
+				continue
+			}
+			out <- record
+			count++
+		}
+
+		if err := scanner.Err(); err != nil {
+			slog.Error("could not read donation file", "file", inputPath, "row", lineNo+1, "error", err)
+			out <- client.DonationRecord{
+				Source: inputPath,
+				Line:   lineNo + 1,
+				Reject: &client.RowError{Line: lineNo + 1, Reason: fmt.Sprintf("read error: %v", err), Abort: strict},
 			}
 		}
 	}()
 	return out, nil
 }
+
+func parseRow(row []string) (client.DonationRecord, *client.RowError) {
+	if len(row) < minFields {
+		return client.DonationRecord{}, &client.RowError{Reason: fmt.Sprintf("expected %d fields", minFields)}
+	}
+
+	reject := func(reason string, err error) (client.DonationRecord, *client.RowError) {
+		return client.DonationRecord{}, &client.RowError{Reason: fmt.Sprintf("%s: %v", reason, err)}
+	}
+
+	amount, err := client.ParseAmount(row[colAmountSubunits])
+	if err != nil {
+		return reject("invalid amount", err)
+	}
+
+	expiry, err := client.ParseExpiry(row[colExpMonth], row[colExpYear])
+	if err != nil {
+		return reject("invalid expiry", err)
+	}
+
+	return client.DonationRecord{
+		Name:   strings.TrimSpace(row[colName]),
+		Amount: amount,
+		Card:   client.NewCard(row[colCCNumber], row[colCVV]),
+		Expiry: expiry,
+	}, nil
+}
+
+// CountRows returns how many data rows StreamAndDecryptFile will read from
+// inputPath, capped by MAX_RECORDS. It is only an estimate for progress
+// reporting, since rejected rows do not count towards the cap.
+func CountRows(inputPath string) (int, error) {
+	inFile, err := os.Open(inputPath)
+	if err != nil {
+		return 0, err
+	}
+	defer inFile.Close()
+
+	reader, err := cipher.NewRot128Reader(inFile)
+	if err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(reader)
+	lineNo := 0
+	count := 0
+	for scanner.Scan() {
+		if maxRecords > 0 && count >= maxRecords {
+			break
+		}
+		lineNo++
+		if lineNo == 1 || scanner.Text() == "" {
+			continue
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"go-tamboon/cipher"
 	"go-tamboon/client"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -29,20 +31,22 @@ func TestStreamAndDecryptFile_Success(t *testing.T) {
 
 	expectedRecords := []client.DonationRecord{
 		{
-			Name:           "John Doe",
-			AmountSubunits: "5000",
-			CCNumber:       "4242424242424242",
-			CVV:            "123",
-			ExpMonth:       "12",
-			ExpYear:        fmt.Sprintf("%d", 2026+expYearIncrease),
+			Source: tempFile,
+			Line:   2,
+			Name:   "John Doe",
+			Amount: client.Amount{Subunits: 5000, Currency: "THB"},
+			Card:   client.NewCard("4242424242424242", "123"),
+			Expiry: client.Expiry{Month: 12, Year: 2026},
+			Row:    client.NewRawRow([]string{"John Doe", "5000", "4242424242424242", "123", "12", "2026"}),
 		},
 		{
-			Name:           "Jane Smith",
-			AmountSubunits: "10000",
-			CCNumber:       "4000000000000002",
-			CVV:            "456",
-			ExpMonth:       "06",
-			ExpYear:        fmt.Sprintf("%d", 2026+expYearIncrease),
+			Source: tempFile,
+			Line:   3,
+			Name:   "Jane Smith",
+			Amount: client.Amount{Subunits: 10000, Currency: "THB"},
+			Card:   client.NewCard("4000000000000002", "456"),
+			Expiry: client.Expiry{Month: 6, Year: 2026},
+			Row:    client.NewRawRow([]string{"Jane Smith", "10000", "4000000000000002", "456", "06", "2026"}),
 		},
 	}
 
@@ -51,7 +55,10 @@ func TestStreamAndDecryptFile_Success(t *testing.T) {
 	}
 
 	for i, expected := range expectedRecords {
-		if records[i] != expected {
+		if records[i].ParseStarted.IsZero() || records[i].ParseFinished.Before(records[i].ParseStarted) {
+			t.Errorf("Record %d has no parse timing: %v - %v", i, records[i].ParseStarted, records[i].ParseFinished)
+		}
+		if !reflect.DeepEqual(withoutTiming(records[i]), expected) {
 			t.Errorf("Record %d mismatch. Expected %+v, got %+v", i, expected, records[i])
 		}
 	}
@@ -108,6 +115,75 @@ func TestStreamAndDecryptFile_EmptyLines(t *testing.T) {
 	}
 }
 
+func TestCountRows(t *testing.T) {
+	testData := "Name,AmountSubunits,CCNumber,CVV,ExpMonth,ExpYear\nJohn Doe,5000,4242424242424242,123,12,2026\n\nbad,row\nJane Smith,10000,4000000000000002,456,06,2026\n"
+
+	tempFile := createTestROT128File(t, testData)
+	defer os.Remove(tempFile)
+
+	rows, err := CountRows(tempFile)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if rows != 3 {
+		t.Errorf("Expected 3 rows, got %d", rows)
+	}
+
+	if _, err := CountRows(tempFile + ".missing"); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func TestQuarantineWriter(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "quarantine")
+	q := NewQuarantineWriter(dir)
+
+	q.Add(client.DonationRecord{Row: client.NewRawRow([]string{"John Doe", "5000", "4242424242424242", "123", "12", "2030"})}, "rate_limit_exceeded", true)
+	q.Add(client.DonationRecord{Row: client.NewRawRow([]string{"Jane Smith", "10000", "4000000000000002", "456", "06", "2030", "network_error"})}, "insufficient_fund", true)
+	q.Add(client.DonationRecord{Row: client.NewRawRow([]string{"bad", "row"})}, "expected 6 fields, got 2", false)
+	q.Add(client.DonationRecord{}, "read error", false)
+
+	if err := q.Close(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	files := q.Files()
+	if len(files) != 2 || !files[0].Retryable || files[0].Rows != 2 || files[1].Retryable || files[1].Rows != 1 {
+		t.Fatalf("Unexpected quarantine files %+v", files)
+	}
+	if !strings.HasSuffix(files[0].Path, "-retryable.rot128") || !strings.HasSuffix(files[1].Path, "-permanent.rot128") {
+		t.Errorf("Unexpected quarantine file names %+v", files)
+	}
+	if info, err := os.Stat(files[0].Path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected quarantine files to be private, got %v %v", info.Mode(), err)
+	}
+
+	permanent := decryptFile(t, files[1].Path)
+	expected := "Name,AmountSubunits,CCNumber,CVV,ExpMonth,ExpYear,FailureReason\nbad,row,expected 6 fields; got 2\n"
+	if permanent != expected {
+		t.Errorf("Expected permanent file %q, got %q", expected, permanent)
+	}
+
+	ch, err := StreamAndDecryptFile(files[0].Path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var names []string
+	for record := range ch {
+		if record.Reject != nil {
+			t.Errorf("Expected the retryable file to parse cleanly, got %v", record.Reject)
+			continue
+		}
+		names = append(names, record.Name)
+		if reason := record.Row.Fields()[record.Row.Len()-1]; record.Row.Len() != 7 || !strings.Contains(reason, "_") {
+			t.Errorf("Expected one failure reason column, got %q", record.Row.Fields())
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"John Doe", "Jane Smith"}) {
+		t.Errorf("Expected both retryable rows, got %v", names)
+	}
+}
+
 func TestStreamAndDecryptFile_InsufficientColumns(t *testing.T) {
 	testData := "Name,AmountSubunits,CCNumber,CVV,ExpMonth,ExpYear\nJohn Doe,5000\nJane Smith,10000,4000000000000002,456,06,2026"
 
@@ -124,21 +200,149 @@ func TestStreamAndDecryptFile_InsufficientColumns(t *testing.T) {
 		records = append(records, record)
 	}
 
-	if len(records) != 1 {
-		t.Errorf("Expected 1 record (line with insufficient columns should be skipped), got %d", len(records))
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records (line with insufficient columns should be rejected), got %d", len(records))
+	}
+
+	rejected := records[0].Reject
+	if rejected == nil {
+		t.Fatalf("Expected first record to be rejected, got %+v", records[0])
+	}
+	if rejected.Line != 2 || rejected.FieldCount != 2 || rejected.Abort {
+		t.Errorf("Unexpected rejection %+v", rejected)
+	}
+	if !reflect.DeepEqual(records[0].Row.Fields(), []string{"John Doe", "5000"}) {
+		t.Errorf("Expected the rejected row to keep its fields, got %q", records[0].Row.Fields())
 	}
 
 	expected := client.DonationRecord{
-		Name:           "Jane Smith",
-		AmountSubunits: "10000",
-		CCNumber:       "4000000000000002",
-		CVV:            "456",
-		ExpMonth:       "06",
-		ExpYear:        fmt.Sprintf("%d", 2026+expYearIncrease),
+		Source: tempFile,
+		Line:   3,
+		Name:   "Jane Smith",
+		Amount: client.Amount{Subunits: 10000, Currency: "THB"},
+		Card:   client.NewCard("4000000000000002", "456"),
+		Expiry: client.Expiry{Month: 6, Year: 2026},
+		Row:    client.NewRawRow([]string{"Jane Smith", "10000", "4000000000000002", "456", "06", "2026"}),
 	}
 
-	if records[0] != expected {
-		t.Errorf("Expected %+v, got %+v", expected, records[0])
+	if !reflect.DeepEqual(withoutTiming(records[1]), expected) {
+		t.Errorf("Expected %+v, got %+v", expected, records[1])
+	}
+}
+
+func TestStreamAndDecryptFile_InvalidExpiryYear(t *testing.T) {
+	testData := "Name,AmountSubunits,CCNumber,CVV,ExpMonth,ExpYear\nJohn Doe,5000,4242424242424242,123,12,20x6"
+
+	tempFile := createTestROT128File(t, testData)
+
+	ch, err := StreamAndDecryptFile(tempFile)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var records []client.DonationRecord
+	for record := range ch {
+		records = append(records, record)
+	}
+
+	if len(records) != 1 || records[0].Reject == nil {
+		t.Fatalf("Expected 1 rejected record, got %+v", records)
+	}
+	if records[0].Reject.Reason != "invalid expiry: expiration year is not a number" {
+		t.Errorf("Unexpected rejection reason %q", records[0].Reject.Reason)
+	}
+}
+
+func TestStreamAndDecryptFile_InvalidValues(t *testing.T) {
+	testData := "Name,AmountSubunits,CCNumber,CVV,ExpMonth,ExpYear\n" +
+		"Garbage,abc,4242424242424242,123,12,2026\n" +
+		"Negative,-100,4242424242424242,123,12,2026\n" +
+		"BadMonth,5000,4242424242424242,123,13,2026\n" +
+		"Jane Smith,10000,4000000000000002,456,06,2026"
+
+	tempFile := createTestROT128File(t, testData)
+
+	ch, err := StreamAndDecryptFile(tempFile)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var reasons []string
+	var accepted []client.DonationRecord
+	for record := range ch {
+		if record.Reject != nil {
+			reasons = append(reasons, record.Reject.Reason)
+			continue
+		}
+		accepted = append(accepted, record)
+	}
+
+	expectedReasons := []string{
+		"invalid amount: amount is not an integer",
+		"invalid amount: amount must be positive",
+		"invalid expiry: expiration month must be between 1 and 12",
+	}
+	if strings.Join(reasons, "|") != strings.Join(expectedReasons, "|") {
+		t.Errorf("Expected reasons %v, got %v", expectedReasons, reasons)
+	}
+	if len(accepted) != 1 || accepted[0].Name != "Jane Smith" {
+		t.Errorf("Expected only Jane Smith to be accepted, got %+v", accepted)
+	}
+}
+
+func TestStreamAndDecryptFile_StrictMode(t *testing.T) {
+	oldMode := parseMode
+	parseMode = parseModeStrict
+	defer func() { parseMode = oldMode }()
+
+	testData := "Name,AmountSubunits,CCNumber,CVV,ExpMonth,ExpYear\nJohn Doe,5000\nJane Smith,10000,4000000000000002,456,06,2026"
+
+	tempFile := createTestROT128File(t, testData)
+
+	ch, err := StreamAndDecryptFile(tempFile)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var records []client.DonationRecord
+	for record := range ch {
+		records = append(records, record)
+	}
+
+	if len(records) != 1 {
+		t.Fatalf("Expected reading to stop at the malformed row, got %d records", len(records))
+	}
+	if records[0].Reject == nil || !records[0].Reject.Abort {
+		t.Errorf("Expected an aborting rejection, got %+v", records[0])
+	}
+}
+
+func TestStreamAndDecryptFile_ReadError(t *testing.T) {
+	testData := "Name,AmountSubunits,CCNumber,CVV,ExpMonth,ExpYear\n" + strings.Repeat("x", 70*1024)
+
+	tempFile := createTestROT128File(t, testData)
+
+	oldMode := parseMode
+	defer func() { parseMode = oldMode }()
+
+	for mode, wantAbort := range map[string]bool{parseModeLenient: false, parseModeStrict: true} {
+		parseMode = mode
+		ch, err := StreamAndDecryptFile(tempFile)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		var records []client.DonationRecord
+		for record := range ch {
+			records = append(records, record)
+		}
+
+		if len(records) != 1 || records[0].Reject == nil {
+			t.Fatalf("%s: expected 1 rejected record, got %d", mode, len(records))
+		}
+		if records[0].Reject.Abort != wantAbort || !strings.HasPrefix(records[0].Reject.Reason, "read error") {
+			t.Errorf("%s: unexpected rejection %+v", mode, records[0].Reject)
+		}
 	}
 }
 
@@ -200,17 +404,225 @@ func TestStreamAndDecryptFile_WhitespaceHandling(t *testing.T) {
 	}
 
 	expected := client.DonationRecord{
-		Name:           "John Doe",
-		AmountSubunits: "5000",
-		CCNumber:       "4242424242424242",
-		CVV:            "123",
-		ExpMonth:       "12",
-		ExpYear:        fmt.Sprintf("%d", 2026+expYearIncrease),
+		Source: tempFile,
+		Line:   2,
+		Name:   "John Doe",
+		Amount: client.Amount{Subunits: 5000, Currency: "THB"},
+		Card:   client.NewCard("4242424242424242", "123"),
+		Expiry: client.Expiry{Month: 12, Year: 2026},
+		Row:    client.NewRawRow([]string{"  John Doe  ", "  5000  ", "  4242424242424242  ", "  123  ", "  12  ", "2026"}),
+	}
+
+	if !reflect.DeepEqual(withoutTiming(records[0]), expected) {
+		t.Errorf("Expected %+v, got %+v", expected, records[0])
+	}
+}
+
+func TestStreamAndDecryptFile_Transforms(t *testing.T) {
+	oldSpec := transformSpec
+	transformSpec = "normalize_name; shift_expiry=5; scale_amount=3/8; test_card=4000000000000002"
+	defer func() { transformSpec = oldSpec }()
+
+	testData := "Name,AmountSubunits,CCNumber,CVV,ExpMonth,ExpYear\n  John \t  Doe ,5000,4242424242424242,123,12,2020\nTiny,1,4242424242424242,123,12,2020"
+
+	tempFile := createTestROT128File(t, testData)
+
+	ch, err := StreamAndDecryptFile(tempFile)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var records []client.DonationRecord
+	for record := range ch {
+		records = append(records, record)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
 	}
 
-	if records[0] != expected {
+	expected := client.DonationRecord{
+		Source:     tempFile,
+		Line:       2,
+		Name:       "John Doe",
+		Amount:     client.Amount{Subunits: 1875, Currency: "THB"},
+		Card:       client.NewCard("4000000000000002", "123"),
+		Expiry:     client.Expiry{Month: 12, Year: 2025},
+		Transforms: []string{"normalize_name", "shift_expiry", "scale_amount", "test_card"},
+		Row:        client.NewRawRow([]string{"  John \t  Doe ", "5000", "4242424242424242", "123", "12", "2020"}),
+	}
+	if !reflect.DeepEqual(withoutTiming(records[0]), expected) {
 		t.Errorf("Expected %+v, got %+v", expected, records[0])
 	}
+
+	if records[1].Reject == nil || records[1].Reject.Reason != "transform scale_amount: amount scales to zero" {
+		t.Errorf("Expected scale_amount rejection, got %+v", records[1].Reject)
+	}
+}
+
+func TestStreamAndDecryptFile_TransformsBlockedForLiveKeys(t *testing.T) {
+	oldSpec := transformSpec
+	transformSpec = "shift_expiry=5"
+	defer func() { transformSpec = oldSpec }()
+	t.Setenv("OMISE_SKEY", "skey_live_123")
+
+	tempFile := createTestROT128File(t, "Name,AmountSubunits,CCNumber,CVV,ExpMonth,ExpYear\nJohn Doe,5000,4242424242424242,123,12,2020")
+
+	_, err := StreamAndDecryptFile(tempFile)
+	if err == nil {
+		t.Fatal("Expected row transforms to be refused with live keys")
+	}
+	if err := CheckTransforms(client.KeyModeLive); err == nil {
+		t.Error("Expected CheckTransforms to refuse live keys")
+	}
+	if err := CheckTransforms(client.KeyModeTest); err != nil {
+		t.Errorf("Expected row transforms to be allowed with test keys, got %v", err)
+	}
+}
+
+func TestParseTransforms(t *testing.T) {
+	cases := []struct {
+		spec    string
+		names   []string
+		wantErr bool
+	}{
+		{spec: "", names: nil},
+		{spec: "shift_expiry=5;;normalize_name", names: []string{"shift_expiry", "normalize_name"}},
+		{spec: "set=name:Anonymous; set=exp_month:1", names: []string{"set", "set"}},
+		{spec: "test_card", names: []string{"test_card"}},
+		{spec: "unknown", wantErr: true},
+		{spec: "shift_expiry=soon", wantErr: true},
+		{spec: "scale_amount=0", wantErr: true},
+		{spec: "scale_amount=1/0", wantErr: true},
+		{spec: "set=amount:-5", wantErr: true},
+		{spec: "set=card:4242", wantErr: true},
+		{spec: "normalize_name=upper", wantErr: true},
+	}
+
+	for _, c := range cases {
+		transforms, err := parseTransforms(c.spec)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("Expected error for %q", c.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error for %q, got %v", c.spec, err)
+			continue
+		}
+		var names []string
+		for _, tr := range transforms {
+			names = append(names, tr.name)
+		}
+		if !reflect.DeepEqual(names, c.names) {
+			t.Errorf("Expected %v for %q, got %v", c.names, c.spec, names)
+		}
+	}
+}
+
+func TestExpandInputPaths(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.rot128", "a.rot128", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub.rot128"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		args    []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "directory",
+			args: []string{dir},
+			want: []string{filepath.Join(dir, "a.rot128"), filepath.Join(dir, "b.rot128")},
+		},
+		{
+			name: "glob",
+			args: []string{filepath.Join(dir, "b*.rot128")},
+			want: []string{filepath.Join(dir, "b.rot128")},
+		},
+		{
+			name: "files are deduplicated",
+			args: []string{filepath.Join(dir, "a.rot128"), dir},
+			want: []string{filepath.Join(dir, "a.rot128"), filepath.Join(dir, "b.rot128")},
+		},
+		{
+			name: "missing file is kept",
+			args: []string{"missing.rot128"},
+			want: []string{"missing.rot128"},
+		},
+		{
+			name:    "unmatched glob",
+			args:    []string{filepath.Join(dir, "*.csv")},
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := ExpandInputPaths(c.args)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("Expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if strings.Join(got, ",") != strings.Join(c.want, ",") {
+				t.Errorf("Expected %v, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.rot128")
+	if err := os.WriteFile(path, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := Fingerprint(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := InputFile{Path: path, SHA256: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", Size: 3}
+	if file != want {
+		t.Errorf("Expected %+v, got %+v", want, file)
+	}
+
+	if _, err := Fingerprint(filepath.Join(dir, "missing.rot128")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func withoutTiming(record client.DonationRecord) client.DonationRecord {
+	record.ParseStarted = time.Time{}
+	record.ParseFinished = time.Time{}
+	return record
+}
+
+func decryptFile(t *testing.T, path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+	reader, _ := cipher.NewRot128Reader(file)
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	return string(data)
 }
 
 func createTestROT128File(t *testing.T, data string) string {
@@ -224,8 +636,7 @@ func createTestROT128File(t *testing.T, data string) string {
 		t.Fatalf("Failed to create ROT128 writer: %v", err)
 	}
 
-	_, err = writer.Write([]byte(data))
-	if err != nil {
+	if _, err := writer.Write([]byte(data)); err != nil {
 		t.Fatalf("Failed to write encrypted data: %v", err)
 	}
 
@@ -0,0 +1,96 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func ExpandInputPaths(args []string) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "*?[") {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %q", arg)
+			}
+			for _, m := range matches {
+				add(m)
+			}
+			continue
+		}
+
+		info, err := os.Stat(arg)
+		if err != nil || !info.IsDir() {
+			add(arg)
+			continue
+		}
+
+		files, err := listInputFiles(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			add(f)
+		}
+	}
+
+	return paths, nil
+}
+
+func listInputFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading directory %s: %v", dir, err)
+	}
+
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != inputFileExtension {
+			continue
+		}
+		files = append(files, filepath.Join(dir, e.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// InputFile identifies the contents of an input file. SHA256 is the hash of
+// the file as stored, so it never depends on the decrypted card data.
+type InputFile struct {
+	Path   string
+	SHA256 string
+	Size   int64
+}
+
+// Fingerprint hashes the file at path.
+func Fingerprint(path string) (InputFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return InputFile{}, fmt.Errorf("opening %s: %v", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return InputFile{}, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return InputFile{Path: path, SHA256: hex.EncodeToString(hash.Sum(nil)), Size: size}, nil
+}
@@ -0,0 +1,129 @@
+package processor
+
+import (
+	"fmt"
+	"go-tamboon/cipher"
+	"go-tamboon/client"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuarantineWriter writes rows that were not charged to rot128 files in a
+// directory, one for retryable failures and one for permanent ones. Each
+// row keeps its original fields plus a FailureReason column, so the
+// retryable file can be passed straight to another run.
+type QuarantineWriter struct {
+	mu    sync.Mutex
+	dir   string
+	stamp string
+	files map[bool]*quarantineFile
+	err   error
+}
+
+type QuarantineFile struct {
+	Path      string
+	Rows      int
+	Retryable bool
+}
+
+type quarantineFile struct {
+	QuarantineFile
+	file   *os.File
+	writer io.Writer
+}
+
+func NewQuarantineWriter(dir string) *QuarantineWriter {
+	return &QuarantineWriter{
+		dir:   dir,
+		stamp: time.Now().Format(quarantineStampFormat),
+		files: make(map[bool]*quarantineFile),
+	}
+}
+
+// Add implements client.Quarantine. Rows without fields, such as a read
+// error, are skipped since there is nothing to resubmit.
+func (q *QuarantineWriter) Add(record client.DonationRecord, reason string, retryable bool) {
+	if record.Row.Len() == 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return
+	}
+
+	f, err := q.file(retryable)
+	if err == nil {
+		// A row quarantined before already carries a reason; replace it.
+		fields := record.Row.Fields()[:min(record.Row.Len(), minFields)]
+		reason = strings.ReplaceAll(reason, fieldSeparator, ";")
+		_, err = fmt.Fprintf(f.writer, "%s%s%s\n", strings.Join(fields, fieldSeparator), fieldSeparator, reason)
+	}
+	if err != nil {
+		q.err = fmt.Errorf("writing quarantine file: %v", err)
+		return
+	}
+	f.Rows++
+}
+
+// Close closes the files and returns the first error seen while writing.
+func (q *QuarantineWriter) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, f := range q.files {
+		if err := f.file.Close(); err != nil && q.err == nil {
+			q.err = err
+		}
+	}
+	return q.err
+}
+
+// Files lists the files written so far, retryable first.
+func (q *QuarantineWriter) Files() []QuarantineFile {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var files []QuarantineFile
+	for _, retryable := range []bool{true, false} {
+		if f, ok := q.files[retryable]; ok {
+			files = append(files, f.QuarantineFile)
+		}
+	}
+	return files
+}
+
+func (q *QuarantineWriter) file(retryable bool) (*quarantineFile, error) {
+	if f, ok := q.files[retryable]; ok {
+		return f, nil
+	}
+
+	kind := quarantinePermanent
+	if retryable {
+		kind = quarantineRetryable
+	}
+	if err := os.MkdirAll(q.dir, 0o700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(q.dir, fmt.Sprintf("%s-%s%s", q.stamp, kind, inputFileExtension))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := cipher.NewRot128Writer(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := fmt.Fprintln(writer, quarantineHeader); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	f := &quarantineFile{QuarantineFile: QuarantineFile{Path: path, Retryable: retryable}, file: file, writer: writer}
+	q.files[retryable] = f
+	return f, nil
+}
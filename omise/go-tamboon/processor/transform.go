@@ -0,0 +1,178 @@
+package processor
+
+import (
+	"fmt"
+	"go-tamboon/client"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type rowTransform struct {
+	name  string
+	apply func(*client.DonationRecord) error
+}
+
+func parseTransforms(spec string) ([]rowTransform, error) {
+	var transforms []rowTransform
+	for _, entry := range strings.Split(spec, transformSeparator) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, arg, _ := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		arg = strings.TrimSpace(arg)
+
+		build, ok := transformBuilders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown row transform %q", name)
+		}
+		apply, err := build(arg)
+		if err != nil {
+			return nil, fmt.Errorf("row transform %q: %v", name, err)
+		}
+		transforms = append(transforms, rowTransform{name: name, apply: apply})
+	}
+	return transforms, nil
+}
+
+func applyTransforms(record *client.DonationRecord, transforms []rowTransform) *client.RowError {
+	for _, t := range transforms {
+		if err := t.apply(record); err != nil {
+			return &client.RowError{Reason: fmt.Sprintf("transform %s: %v", t.name, err)}
+		}
+		record.Transforms = append(record.Transforms, t.name)
+	}
+	return nil
+}
+
+var transformBuilders = map[string]func(arg string) (func(*client.DonationRecord) error, error){
+	"shift_expiry":   shiftExpiry,
+	"scale_amount":   scaleAmount,
+	"test_card":      testCard,
+	"normalize_name": normalizeName,
+	"set":            setField,
+}
+
+func shiftExpiry(arg string) (func(*client.DonationRecord) error, error) {
+	years, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, fmt.Errorf("expected a number of years")
+	}
+	return func(r *client.DonationRecord) error {
+		expiry, err := client.NewExpiry(r.Expiry.Month, r.Expiry.Year+years)
+		if err != nil {
+			return err
+		}
+		r.Expiry = expiry
+		return nil
+	}, nil
+}
+
+func scaleAmount(arg string) (func(*client.DonationRecord) error, error) {
+	numStr, denStr, hasDen := strings.Cut(arg, "/")
+	num, err := strconv.ParseInt(numStr, 10, 64)
+	if err != nil || num <= 0 {
+		return nil, fmt.Errorf("expected a positive factor such as 100 or 1/100")
+	}
+	den := int64(1)
+	if hasDen {
+		den, err = strconv.ParseInt(denStr, 10, 64)
+		if err != nil || den <= 0 {
+			return nil, fmt.Errorf("expected a positive factor such as 100 or 1/100")
+		}
+	}
+	return func(r *client.DonationRecord) error {
+		scaled, err := r.Amount.Mul(num, den)
+		if err != nil {
+			return err
+		}
+		if scaled.Subunits <= 0 {
+			return fmt.Errorf("amount scales to zero")
+		}
+		r.Amount = scaled
+		return nil
+	}, nil
+}
+
+func testCard(arg string) (func(*client.DonationRecord) error, error) {
+	number, cvv, _ := strings.Cut(arg, ":")
+	if number == "" {
+		number = defaultTestCard
+	}
+	return func(r *client.DonationRecord) error {
+		if cvv == "" {
+			r.Card = client.NewCard(number, r.Card.CVV())
+		} else {
+			r.Card = client.NewCard(number, cvv)
+		}
+		return nil
+	}, nil
+}
+
+func normalizeName(arg string) (func(*client.DonationRecord) error, error) {
+	if arg != "" {
+		return nil, fmt.Errorf("takes no argument")
+	}
+	return func(r *client.DonationRecord) error {
+		name := strings.Map(func(c rune) rune {
+			if unicode.IsControl(c) {
+				return ' '
+			}
+			return c
+		}, r.Name)
+		r.Name = strings.Join(strings.Fields(name), " ")
+		return nil
+	}, nil
+}
+
+func setField(arg string) (func(*client.DonationRecord) error, error) {
+	field, value, ok := strings.Cut(arg, ":")
+	if !ok {
+		return nil, fmt.Errorf("expected field:value")
+	}
+
+	switch field {
+	case "name":
+		return func(r *client.DonationRecord) error {
+			r.Name = value
+			return nil
+		}, nil
+	case "amount":
+		amount, err := client.ParseAmount(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *client.DonationRecord) error {
+			r.Amount = amount
+			return nil
+		}, nil
+	case "cvv":
+		return func(r *client.DonationRecord) error {
+			r.Card = client.NewCard(r.Card.Number(), value)
+			return nil
+		}, nil
+	case "exp_month", "exp_year":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a number", field)
+		}
+		return func(r *client.DonationRecord) error {
+			month, year := r.Expiry.Month, r.Expiry.Year
+			if field == "exp_month" {
+				month = n
+			} else {
+				year = n
+			}
+			expiry, err := client.NewExpiry(month, year)
+			if err != nil {
+				return err
+			}
+			r.Expiry = expiry
+			return nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported field %q", field)
+}
@@ -0,0 +1,10 @@
+package progress
+
+import "time"
+
+const (
+	ttyInterval = 250 * time.Millisecond
+	logInterval = 10 * time.Second
+
+	msgProgress = "rows %d/%s | ok %d | failed %d | %.1f/s | limiter pauses %d (%s) | eta %s"
+)
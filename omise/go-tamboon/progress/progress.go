@@ -0,0 +1,188 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Reporter struct {
+	total     atomic.Int64
+	read      atomic.Int64
+	succeeded atomic.Int64
+	failed    atomic.Int64
+
+	mu       sync.Mutex
+	pauses   func() (int, time.Duration)
+	out      io.Writer
+	tty      bool
+	interval time.Duration
+	start    time.Time
+	now      func() time.Time
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+type Snapshot struct {
+	Total     int64
+	Read      int64
+	Succeeded int64
+	Failed    int64
+	Rate      float64
+	Pauses    int
+	Paused    time.Duration
+	ETA       time.Duration
+	Elapsed   time.Duration
+}
+
+// New renders to out as a single live line when out is a terminal and as
+// periodic log lines otherwise.
+func New(out io.Writer) *Reporter {
+	tty := IsTerminal(out)
+	interval := logInterval
+	if tty {
+		interval = ttyInterval
+	}
+	return &Reporter{out: out, tty: tty, interval: interval, now: time.Now}
+}
+
+func IsTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (r *Reporter) AddTotal(n int64) {
+	if r != nil {
+		r.total.Add(n)
+	}
+}
+
+func (r *Reporter) RowRead() {
+	if r != nil {
+		r.read.Add(1)
+	}
+}
+
+func (r *Reporter) Succeeded() {
+	if r != nil {
+		r.succeeded.Add(1)
+	}
+}
+
+func (r *Reporter) Failed() {
+	if r != nil {
+		r.failed.Add(1)
+	}
+}
+
+func (r *Reporter) SetPauseSource(stats func() (int, time.Duration)) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.pauses = stats
+	r.mu.Unlock()
+}
+
+func (r *Reporter) Start() {
+	r.mu.Lock()
+	r.start = r.now()
+	stop, done := make(chan struct{}), make(chan struct{})
+	r.stop, r.done = stop, done
+	r.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.render()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop renders a final update and ends the live line. It is safe to call
+// more than once and on a reporter that was never started.
+func (r *Reporter) Stop() {
+	if r == nil {
+		return
+	}
+	r.stopOnce.Do(func() {
+		r.mu.Lock()
+		stop, done := r.stop, r.done
+		r.mu.Unlock()
+		if stop == nil {
+			return
+		}
+		close(stop)
+		<-done
+		r.render()
+		if r.tty {
+			fmt.Fprintln(r.out)
+		}
+	})
+}
+
+func (r *Reporter) Snapshot() Snapshot {
+	r.mu.Lock()
+	pauses, start := r.pauses, r.start
+	r.mu.Unlock()
+
+	s := Snapshot{
+		Total:     r.total.Load(),
+		Read:      r.read.Load(),
+		Succeeded: r.succeeded.Load(),
+		Failed:    r.failed.Load(),
+		Elapsed:   r.now().Sub(start),
+	}
+	if pauses != nil {
+		s.Pauses, s.Paused = pauses()
+	}
+
+	done := s.Succeeded + s.Failed
+	if s.Elapsed > 0 {
+		s.Rate = float64(done) / s.Elapsed.Seconds()
+	}
+	if s.Rate > 0 && s.Total > done {
+		s.ETA = time.Duration(float64(s.Total-done) / s.Rate * float64(time.Second)).Round(time.Second)
+	}
+	return s
+}
+
+func (s Snapshot) String() string {
+	total := "?"
+	if s.Total > 0 {
+		total = fmt.Sprint(s.Total)
+	}
+	eta := "-"
+	if s.ETA > 0 {
+		eta = s.ETA.String()
+	}
+	return fmt.Sprintf(msgProgress, s.Read, total, s.Succeeded, s.Failed, s.Rate,
+		s.Pauses, s.Paused.Round(time.Second), eta)
+}
+
+func (r *Reporter) render() {
+	s := r.Snapshot()
+	if r.tty {
+		fmt.Fprintf(r.out, "\r\033[K%s", s)
+		return
+	}
+	slog.Info("progress", "rows_read", s.Read, "rows_total", s.Total, "succeeded", s.Succeeded,
+		"failed", s.Failed, "rate_per_second", fmt.Sprintf("%.1f", s.Rate),
+		"limiter_pauses", s.Pauses, "limiter_paused", s.Paused.Round(time.Second).String(), "eta", s.ETA.String())
+}
@@ -0,0 +1,112 @@
+package progress
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	r := New(&bytes.Buffer{})
+	r.now = func() time.Time { return now }
+	r.start = start
+	r.SetPauseSource(func() (int, time.Duration) { return 2, 10 * time.Second })
+	r.AddTotal(100)
+
+	for i := 0; i < 30; i++ {
+		r.RowRead()
+		if i%3 == 0 {
+			r.Failed()
+		} else {
+			r.Succeeded()
+		}
+	}
+	now = start.Add(10 * time.Second)
+
+	s := r.Snapshot()
+	if s.Read != 30 || s.Succeeded != 20 || s.Failed != 10 || s.Total != 100 {
+		t.Errorf("Unexpected counters: %+v", s)
+	}
+	if s.Rate != 3 {
+		t.Errorf("Expected 3 rows/s, got %v", s.Rate)
+	}
+	if s.ETA != 23*time.Second {
+		t.Errorf("Expected ETA of 23s, got %v", s.ETA)
+	}
+	if s.Pauses != 2 || s.Paused != 10*time.Second {
+		t.Errorf("Expected 2 pauses totalling 10s, got %d and %v", s.Pauses, s.Paused)
+	}
+
+	expected := "rows 30/100 | ok 20 | failed 10 | 3.0/s | limiter pauses 2 (10s) | eta 23s"
+	if got := s.String(); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestSnapshot_UnknownTotal(t *testing.T) {
+	r := New(&bytes.Buffer{})
+	r.start = time.Now()
+	r.RowRead()
+
+	got := r.Snapshot().String()
+	if !strings.HasPrefix(got, "rows 1/? ") || !strings.HasSuffix(got, "eta -") {
+		t.Errorf("Expected unknown total and ETA, got %q", got)
+	}
+}
+
+func TestReporter_LogLinesWhenNotATerminal(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	var out bytes.Buffer
+	r := New(&out)
+	if r.tty {
+		t.Fatal("Expected a buffer not to be treated as a terminal")
+	}
+	r.interval = 10 * time.Millisecond
+	r.AddTotal(2)
+	r.Start()
+	r.RowRead()
+	r.Succeeded()
+	time.Sleep(30 * time.Millisecond)
+	r.Stop()
+	r.Stop()
+
+	if out.Len() != 0 {
+		t.Errorf("Expected nothing written to the output, got %q", out.String())
+	}
+	if !strings.Contains(logs.String(), "msg=progress rows_read=1 rows_total=2 succeeded=1") {
+		t.Errorf("Expected progress log lines, got:\n%s", logs.String())
+	}
+}
+
+func TestReporter_LiveLineOnTerminal(t *testing.T) {
+	var out bytes.Buffer
+	r := New(&out)
+	r.tty = true
+	r.interval = time.Hour
+	r.Start()
+	r.RowRead()
+	r.Failed()
+	r.Stop()
+
+	got := out.String()
+	if !strings.HasPrefix(got, "\r\033[Krows 1/? | ok 0 | failed 1") || !strings.HasSuffix(got, "\n") {
+		t.Errorf("Expected a single live line ending the run, got %q", got)
+	}
+}
+
+func TestReporter_NilIsNoop(t *testing.T) {
+	var r *Reporter
+	r.AddTotal(1)
+	r.RowRead()
+	r.Succeeded()
+	r.Failed()
+	r.SetPauseSource(nil)
+	r.Stop()
+}
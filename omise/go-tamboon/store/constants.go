@@ -0,0 +1,69 @@
+package store
+
+const (
+	driverName = "sqlite"
+
+	donorIDName = "name:"
+	timeLayout  = "2006-01-02T15:04:05.000000000Z07:00"
+)
+
+// pragmas are applied to every connection. Foreign keys keep donations and
+// files tied to their run, and the busy timeout lets two runs share a file.
+var pragmas = []string{
+	"PRAGMA foreign_keys = ON",
+	"PRAGMA busy_timeout = 5000",
+}
+
+// migrations are applied in order, each in its own transaction, and the
+// database's user_version records how many have run. Append new migrations;
+// never edit one that has been released.
+var migrations = []string{
+	`CREATE TABLE runs (
+		id          INTEGER PRIMARY KEY,
+		started_at  TEXT NOT NULL,
+		finished_at TEXT NOT NULL,
+		duration_ns INTEGER NOT NULL,
+		mode        TEXT NOT NULL,
+		currency    TEXT NOT NULL,
+		received    INTEGER NOT NULL,
+		donated     INTEGER NOT NULL,
+		donations   INTEGER NOT NULL,
+		succeeded   INTEGER NOT NULL,
+		failed      INTEGER NOT NULL
+	);
+	CREATE TABLE run_files (
+		run_id INTEGER NOT NULL REFERENCES runs(id),
+		path   TEXT NOT NULL,
+		sha256 TEXT,
+		size   INTEGER,
+		error  TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX run_files_sha256 ON run_files(sha256);
+	CREATE TABLE donations (
+		id          INTEGER PRIMARY KEY,
+		run_id      INTEGER NOT NULL REFERENCES runs(id),
+		donation_id TEXT NOT NULL,
+		source      TEXT NOT NULL,
+		line        INTEGER NOT NULL,
+		donor_id    TEXT NOT NULL,
+		name        TEXT NOT NULL,
+		amount      INTEGER NOT NULL,
+		currency    TEXT NOT NULL,
+		status      TEXT NOT NULL,
+		reason      TEXT NOT NULL DEFAULT '',
+		charge_id   TEXT NOT NULL DEFAULT '',
+		year        INTEGER NOT NULL
+	);
+	CREATE INDEX donations_donor ON donations(donor_id, year);
+	CREATE INDEX donations_year ON donations(year, status);
+	CREATE TABLE donors (
+		donor_id   TEXT NOT NULL,
+		currency   TEXT NOT NULL,
+		name       TEXT NOT NULL,
+		total      INTEGER NOT NULL,
+		donations  INTEGER NOT NULL,
+		first_seen TEXT NOT NULL,
+		last_seen  TEXT NOT NULL,
+		PRIMARY KEY (donor_id, currency)
+	);`,
+}
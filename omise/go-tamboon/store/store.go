@@ -0,0 +1,393 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-tamboon/client"
+	"go-tamboon/money"
+	"go-tamboon/processor"
+	"slices"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Store keeps the history of donation runs and a ledger of what every donor
+// gave in a local SQLite database. Donations are stored with their charge ID,
+// amount and outcome; card data is never written.
+type Store struct {
+	db *sql.DB
+}
+
+var _ client.ChargeHistory = (*Store)(nil)
+
+// FileRun is an earlier run that processed an input file.
+type FileRun struct {
+	RunID    int64
+	Path     string
+	Finished time.Time
+}
+
+// LedgerEntry is what one donor gave successfully in one currency.
+type LedgerEntry struct {
+	DonorID   string
+	Name      string
+	Amount    money.Amount
+	Donations int
+}
+
+// Open opens the database at path, creating it if needed, and brings its
+// schema up to date.
+func Open(path string) (*Store, error) {
+	db, err := sql.Open(driverName, path)
+	if err != nil {
+		return nil, fmt.Errorf("opening history database: %v", err)
+	}
+	// A single connection keeps the pragmas in effect and serialises writes.
+	db.SetMaxOpenConns(1)
+	for _, pragma := range pragmas {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("opening history database: %v", err)
+		}
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("reading schema version: %v", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("history database has schema version %d, this build supports up to %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("migrating history database: %v", err)
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("applying migration %d: %v", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("applying migration %d: %v", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("applying migration %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// SaveRun records result, the fingerprints of its input files and every
+// donation outcome, and adds its successful donations to the donor totals.
+// It returns the new run's ID.
+func (s *Store) SaveRun(result *client.RunResult, files []processor.InputFile) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("saving run: %v", err)
+	}
+	runID, err := startRun(tx, result.Mode, result.Currency, result.Started, files)
+	if err == nil {
+		err = finishRun(tx, runID, result, files)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("saving run: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("saving run: %v", err)
+	}
+	return runID, nil
+}
+
+// StartRun records a run and its input files before any donation is
+// charged, so the files count as processed even if the run never finishes.
+// FinishRun completes the record.
+func (s *Store) StartRun(mode client.KeyMode, currency string, started time.Time, files []processor.InputFile) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("starting run: %v", err)
+	}
+	runID, err := startRun(tx, mode, currency, started, files)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("starting run: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("starting run: %v", err)
+	}
+	return runID, nil
+}
+
+// FinishRun records the result of a run begun with StartRun, as SaveRun
+// would.
+func (s *Store) FinishRun(runID int64, result *client.RunResult, files []processor.InputFile) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("saving run: %v", err)
+	}
+	if err := finishRun(tx, runID, result, files); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("saving run: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("saving run: %v", err)
+	}
+	return nil
+}
+
+// startRun inserts a run with no donations yet. Its finish time is its start
+// time until finishRun sets it.
+func startRun(tx *sql.Tx, mode client.KeyMode, currency string, started time.Time, files []processor.InputFile) (int64, error) {
+	res, err := tx.Exec(`INSERT INTO runs (started_at, finished_at, duration_ns, mode, currency,
+		received, donated, donations, succeeded, failed) VALUES (?, ?, 0, ?, ?, 0, 0, 0, 0, 0)`,
+		formatTime(started), formatTime(started), string(mode), currency)
+	if err != nil {
+		return 0, err
+	}
+	runID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range files {
+		if _, err := tx.Exec(`INSERT INTO run_files (run_id, path, sha256, size) VALUES (?, ?, ?, ?)`,
+			runID, f.Path, f.SHA256, f.Size); err != nil {
+			return 0, err
+		}
+	}
+	return runID, nil
+}
+
+func finishRun(tx *sql.Tx, runID int64, result *client.RunResult, files []processor.InputFile) error {
+	if _, err := tx.Exec(`UPDATE runs SET started_at = ?, finished_at = ?, duration_ns = ?, mode = ?, currency = ?,
+		received = ?, donated = ?, donations = ?, succeeded = ?, failed = ? WHERE id = ?`,
+		formatTime(result.Started), formatTime(result.Finished), int64(result.Duration), string(result.Mode),
+		result.Currency, result.Received.Subunits, result.Donated.Subunits,
+		result.Donations, result.Succeeded, result.Failed, runID); err != nil {
+		return err
+	}
+
+	// The files are recorded again now that the run knows which failed.
+	if _, err := tx.Exec(`DELETE FROM run_files WHERE run_id = ?`, runID); err != nil {
+		return err
+	}
+	fingerprints := make(map[string]processor.InputFile, len(files))
+	for _, f := range files {
+		fingerprints[f.Path] = f
+	}
+	for _, file := range result.Files {
+		var hash sql.NullString
+		var size sql.NullInt64
+		if f, ok := fingerprints[file.Path]; ok {
+			hash = sql.NullString{String: f.SHA256, Valid: true}
+			size = sql.NullInt64{Int64: f.Size, Valid: true}
+		}
+		if _, err := tx.Exec(`INSERT INTO run_files (run_id, path, sha256, size, error) VALUES (?, ?, ?, ?, ?)`,
+			runID, file.Path, hash, size, file.Error); err != nil {
+			return err
+		}
+	}
+
+	year := result.Finished.Year()
+	for _, o := range result.Outcomes {
+		currency := o.Amount.Currency
+		if currency == "" {
+			currency = result.Currency
+		}
+		if _, err := tx.Exec(`INSERT INTO donations (run_id, donation_id, source, line, donor_id, name,
+			amount, currency, status, reason, charge_id, year) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			runID, o.ID, o.Source, o.Line, o.DonorID, o.Name, o.Amount.Subunits, currency,
+			string(o.Outcome), o.Reason, o.ChargeID, year); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range result.Donors {
+		if err := addToDonor(tx, d, result.Finished); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addToDonor adds a run's total for one donor to their lifetime total. The
+// sum is checked in Go because SQLite silently turns an overflowing integer
+// addition into a float.
+func addToDonor(tx *sql.Tx, d client.DonorTotal, seen time.Time) error {
+	var subunits int64
+	var donations int
+	err := tx.QueryRow(`SELECT total, donations FROM donors WHERE donor_id = ? AND currency = ?`,
+		d.ID, d.Amount.Currency).Scan(&subunits, &donations)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	total, err := money.New(subunits, d.Amount.Currency).Add(d.Amount)
+	if err != nil {
+		return fmt.Errorf("donor %s: %v", d.ID, err)
+	}
+	_, err = tx.Exec(`INSERT INTO donors (donor_id, currency, name, total, donations, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (donor_id, currency) DO UPDATE SET
+			name = excluded.name, total = excluded.total, donations = excluded.donations, last_seen = excluded.last_seen`,
+		d.ID, d.Amount.Currency, d.Name, total.Subunits, donations+d.Donations, formatTime(seen), formatTime(seen))
+	return err
+}
+
+// FileRuns returns the runs with mode keys that processed a file with the
+// given SHA-256, most recent first.
+func (s *Store) FileRuns(sha256 string, mode client.KeyMode) ([]FileRun, error) {
+	rows, err := s.db.Query(`SELECT r.id, f.path, r.finished_at FROM run_files f JOIN runs r ON r.id = f.run_id
+		WHERE f.sha256 = ? AND f.error = '' AND r.mode = ? ORDER BY r.id DESC`, sha256, string(mode))
+	if err != nil {
+		return nil, fmt.Errorf("reading processed files: %v", err)
+	}
+	defer rows.Close()
+
+	var runs []FileRun
+	for rows.Next() {
+		var run FileRun
+		var finished string
+		if err := rows.Scan(&run.RunID, &run.Path, &finished); err != nil {
+			return nil, fmt.Errorf("reading processed files: %v", err)
+		}
+		run.Finished, _ = time.Parse(timeLayout, finished)
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading processed files: %v", err)
+	}
+	return runs, nil
+}
+
+// PreviousCharge implements client.ChargeHistory. Names are compared in Go
+// because SQLite's lower() only folds ASCII.
+func (s *Store) PreviousCharge(mode client.KeyMode, donorID string, amount money.Amount, name string, since time.Time) (string, error) {
+	rows, err := s.db.Query(`SELECT d.donation_id, d.name FROM donations d JOIN runs r ON r.id = d.run_id
+		WHERE d.donor_id = ? AND d.amount = ? AND d.currency = ? AND d.status = ? AND r.mode = ? AND r.finished_at >= ?
+		ORDER BY r.id DESC`,
+		donorID, amount.Subunits, amount.Currency, string(client.OutcomeSucceeded), string(mode), formatTime(since))
+	if err != nil {
+		return "", fmt.Errorf("reading donation history: %v", err)
+	}
+	defer rows.Close()
+
+	want := normalizeName(name)
+	for rows.Next() {
+		var id, previousName string
+		if err := rows.Scan(&id, &previousName); err != nil {
+			return "", fmt.Errorf("reading donation history: %v", err)
+		}
+		if normalizeName(previousName) == want {
+			return id, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("reading donation history: %v", err)
+	}
+	return "", nil
+}
+
+// YearEndReport returns what every donor gave successfully in year, largest
+// donor first within each currency.
+func (s *Store) YearEndReport(year int) ([]LedgerEntry, error) {
+	return s.ledger(year, nil)
+}
+
+// DonorYear returns what donor gave successfully in year. donor is a donor
+// ID or any name the donor used, ignoring case and spacing; a name shared by
+// several people matches each of them.
+func (s *Store) DonorYear(donor string, year int) ([]LedgerEntry, error) {
+	ids, err := s.donorIDs(donor)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	return s.ledger(year, ids)
+}
+
+// donorIDs returns the donors that donor names. Names are compared in Go, as
+// in PreviousCharge, since SQLite only folds the case of ASCII letters.
+func (s *Store) donorIDs(donor string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT donor_id, name FROM donations`)
+	if err != nil {
+		return nil, fmt.Errorf("reading donors: %v", err)
+	}
+	defer rows.Close()
+
+	want := normalizeName(donor)
+	var ids []string
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, fmt.Errorf("reading donors: %v", err)
+		}
+		if (id == donor || id == donorIDName+want || normalizeName(name) == want) && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading donors: %v", err)
+	}
+	return ids, nil
+}
+
+// ledger totals the successful donations of year by donor, only for the
+// donors in ids unless ids is nil.
+func (s *Store) ledger(year int, ids []string) ([]LedgerEntry, error) {
+	query := `SELECT d.donor_id, COALESCE(dn.name, MIN(d.name)), d.currency, SUM(d.amount), COUNT(*)
+		FROM donations d LEFT JOIN donors dn ON dn.donor_id = d.donor_id AND dn.currency = d.currency
+		WHERE d.status = ? AND d.year = ?`
+	args := []any{string(client.OutcomeSucceeded), year}
+	if ids != nil {
+		query += ` AND d.donor_id IN (?` + strings.Repeat(", ?", len(ids)-1) + `)`
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	query += ` GROUP BY d.donor_id, d.currency ORDER BY d.currency, SUM(d.amount) DESC, 2, d.donor_id`
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("reading ledger: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		var currency string
+		var subunits int64
+		if err := rows.Scan(&e.DonorID, &e.Name, &currency, &subunits, &e.Donations); err != nil {
+			return nil, fmt.Errorf("reading ledger: %v", err)
+		}
+		e.Amount = money.New(subunits, currency)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading ledger: %v", err)
+	}
+	return entries, nil
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
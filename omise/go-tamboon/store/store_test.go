@@ -0,0 +1,319 @@
+package store
+
+import (
+	"database/sql"
+	"go-tamboon/client"
+	"go-tamboon/money"
+	"go-tamboon/processor"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenMigrates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	s.Close()
+
+	// Reopening an up-to-date database must not reapply migrations.
+	s, err = Open(path)
+	if err != nil {
+		t.Fatalf("Expected no error on reopen, got %v", err)
+	}
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Errorf("Expected schema version %d, got %d", len(migrations), version)
+	}
+	if _, err := s.db.Exec("PRAGMA user_version = 999"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if _, err := Open(path); err == nil || !strings.Contains(err.Error(), "schema version 999") {
+		t.Errorf("Expected a newer schema to be refused, got %v", err)
+	}
+}
+
+func TestSaveRunAndLedger(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	thb := func(subunits int64) money.Amount { return money.New(subunits, "THB") }
+	jan := time.Date(2026, time.January, 10, 9, 0, 0, 0, time.UTC)
+
+	first := runResult(jan, []client.DonationOutcome{
+		{ID: "a", DonorID: "card:fp1", Source: "a.rot128", Line: 2, Name: "Jane Doe", Amount: thb(5000), Card: "424242******4242", Outcome: client.OutcomeSucceeded, ChargeID: "chrg_1"},
+		{ID: "b", DonorID: "name:john smith", Source: "a.rot128", Line: 3, Name: "John Smith", Amount: thb(2000), Outcome: client.OutcomeFailed, Reason: "insufficient_fund"},
+		{ID: "c", DonorID: "card:fp2", Source: "a.rot128", Line: 4, Name: "Bob", Amount: thb(1000), Outcome: client.OutcomeSucceeded, ChargeID: "chrg_2"},
+	}, client.DonorTotal{ID: "card:fp1", Name: "Jane Doe", Amount: thb(5000), Donations: 1},
+		client.DonorTotal{ID: "card:fp2", Name: "Bob", Amount: thb(1000), Donations: 1})
+	files := []processor.InputFile{{Path: "a.rot128", SHA256: "abc123", Size: 42}}
+	runID, err := s.SaveRun(first, files)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if runID != 1 {
+		t.Errorf("Expected run ID 1, got %d", runID)
+	}
+
+	second := runResult(jan.AddDate(0, 1, 0), []client.DonationOutcome{
+		{ID: "d", DonorID: "card:fp1", Source: "a.rot128", Line: 2, Name: "JANE DOE", Amount: thb(3000), Outcome: client.OutcomeSucceeded, ChargeID: "chrg_3"},
+	}, client.DonorTotal{ID: "card:fp1", Name: "JANE DOE", Amount: thb(3000), Donations: 1})
+	if _, err := s.SaveRun(second, files); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	lastYear := runResult(jan.AddDate(-1, 0, 0), []client.DonationOutcome{
+		{ID: "e", DonorID: "card:fp1", Source: "a.rot128", Line: 2, Name: "Jane Doe", Amount: thb(7000), Outcome: client.OutcomeSucceeded, ChargeID: "chrg_0"},
+		{ID: "f", DonorID: "card:fp3", Source: "a.rot128", Line: 3, Name: "ÉMILE  Zola", Amount: thb(4000), Outcome: client.OutcomeSucceeded, ChargeID: "chrg_00"},
+	}, client.DonorTotal{ID: "card:fp1", Name: "Jane Doe", Amount: thb(7000), Donations: 1},
+		client.DonorTotal{ID: "card:fp3", Name: "ÉMILE  Zola", Amount: thb(4000), Donations: 1})
+	if _, err := s.SaveRun(lastYear, files); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	report, err := s.YearEndReport(2026)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := []LedgerEntry{
+		{DonorID: "card:fp1", Name: "Jane Doe", Amount: thb(8000), Donations: 2},
+		{DonorID: "card:fp2", Name: "Bob", Amount: thb(1000), Donations: 1},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("Expected report %+v, got %+v", want, report)
+	}
+
+	cases := []struct {
+		name  string
+		donor string
+		year  int
+		want  []LedgerEntry
+	}{
+		{name: "by ID", donor: "card:fp2", year: 2026, want: want[1:]},
+		{name: "by any spelling", donor: "  jane   doe ", year: 2026, want: want[:1]},
+		{name: "other year", donor: "Jane Doe", year: 2025, want: []LedgerEntry{{DonorID: "card:fp1", Name: "Jane Doe", Amount: thb(7000), Donations: 1}}},
+		{name: "by a name beyond ASCII", donor: "émile zola", year: 2025, want: []LedgerEntry{{DonorID: "card:fp3", Name: "ÉMILE  Zola", Amount: thb(4000), Donations: 1}}},
+		{name: "only failed donations", donor: "John Smith", year: 2026, want: nil},
+		{name: "unknown donor", donor: "nobody", year: 2026, want: nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := s.DonorYear(c.donor, c.year)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Expected %+v, got %+v", c.want, got)
+			}
+		})
+	}
+
+	var total int64
+	var donations int
+	if err := s.db.QueryRow(`SELECT total, donations FROM donors WHERE donor_id = 'card:fp1'`).Scan(&total, &donations); err != nil {
+		t.Fatal(err)
+	}
+	if total != 15000 || donations != 3 {
+		t.Errorf("Expected lifetime total 15000 over 3 donations, got %d over %d", total, donations)
+	}
+
+	var hash sql.NullString
+	if err := s.db.QueryRow(`SELECT sha256 FROM run_files WHERE run_id = 1`).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	if hash.String != "abc123" {
+		t.Errorf("Expected file hash abc123, got %q", hash.String)
+	}
+
+	var chargeID, reason string
+	if err := s.db.QueryRow(`SELECT charge_id, reason FROM donations WHERE donation_id = 'b'`).Scan(&chargeID, &reason); err != nil {
+		t.Fatal(err)
+	}
+	if chargeID != "" || reason != "insufficient_fund" {
+		t.Errorf("Expected failed donation without charge ID, got %q (%q)", chargeID, reason)
+	}
+}
+
+func TestSaveRunNeverStoresCards(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	result := runResult(time.Now(), []client.DonationOutcome{
+		{ID: "a", DonorID: "card:fp1", Name: "Jane Doe", Amount: money.New(100, "THB"), Card: "424242******4242", Outcome: client.OutcomeSucceeded},
+	})
+	if _, err := s.SaveRun(result, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := s.db.Query(`SELECT name FROM pragma_table_info('donations')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(column, "card") || strings.Contains(column, "cvv") {
+			t.Errorf("Unexpected card column %q", column)
+		}
+	}
+}
+
+func TestSaveRunOverflowRollsBack(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	huge := money.New(1<<62, "THB")
+	outcome := client.DonationOutcome{ID: "a", DonorID: "card:fp1", Name: "Jane Doe", Amount: huge, Outcome: client.OutcomeSucceeded}
+	donor := client.DonorTotal{ID: "card:fp1", Name: "Jane Doe", Amount: huge, Donations: 1}
+	if _, err := s.SaveRun(runResult(time.Now(), []client.DonationOutcome{outcome}, donor), nil); err != nil {
+		t.Fatal(err)
+	}
+	outcome.ID = "b"
+	if _, err := s.SaveRun(runResult(time.Now(), []client.DonationOutcome{outcome}, donor), nil); err == nil {
+		t.Fatal("Expected the donor total to overflow")
+	}
+
+	var runs int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM runs`).Scan(&runs); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 1 {
+		t.Errorf("Expected the failed run to be rolled back, got %d runs", runs)
+	}
+}
+
+func TestFileRunsAndPreviousCharge(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Now()
+	amount := money.New(5000, "THB")
+	result := runResult(now, []client.DonationOutcome{
+		{ID: "a.rot128:2", DonorID: "card:fp1", Name: "Jane  Doe", Amount: amount, Outcome: client.OutcomeSucceeded},
+		{ID: "a.rot128:3", DonorID: "card:fp2", Name: "Bob", Amount: amount, Outcome: client.OutcomeFailed},
+	})
+	runID, err := s.SaveRun(result, []processor.InputFile{{Path: "a.rot128", SHA256: "abc123", Size: 42}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runs, err := s.FileRuns("abc123", client.KeyModeTest)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(runs) != 1 || runs[0].RunID != runID || runs[0].Path != "a.rot128" || !runs[0].Finished.Equal(now.Round(0)) {
+		t.Errorf("Expected run %d of a.rot128 at %v, got %+v", runID, now, runs)
+	}
+	if runs, _ := s.FileRuns("abc123", client.KeyModeLive); len(runs) != 0 {
+		t.Errorf("Expected no live runs, got %+v", runs)
+	}
+	if runs, _ := s.FileRuns("other", client.KeyModeTest); len(runs) != 0 {
+		t.Errorf("Expected no runs for another file, got %+v", runs)
+	}
+
+	hour := now.Add(-time.Hour)
+	cases := []struct {
+		name    string
+		mode    client.KeyMode
+		donorID string
+		amount  money.Amount
+		donor   string
+		since   time.Time
+		want    string
+	}{
+		{name: "same donation", mode: client.KeyModeTest, donorID: "card:fp1", amount: amount, donor: "jane doe", since: hour, want: "a.rot128:2"},
+		{name: "other amount", mode: client.KeyModeTest, donorID: "card:fp1", amount: money.New(5001, "THB"), donor: "Jane Doe", since: hour},
+		{name: "other name", mode: client.KeyModeTest, donorID: "card:fp1", amount: amount, donor: "John Doe", since: hour},
+		{name: "outside window", mode: client.KeyModeTest, donorID: "card:fp1", amount: amount, donor: "Jane Doe", since: now.Add(time.Minute)},
+		{name: "other key mode", mode: client.KeyModeLive, donorID: "card:fp1", amount: amount, donor: "Jane Doe", since: hour},
+		{name: "failed charge", mode: client.KeyModeTest, donorID: "card:fp2", amount: amount, donor: "Bob", since: hour},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := s.PreviousCharge(c.mode, c.donorID, c.amount, c.donor, c.since)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if got != c.want {
+				t.Errorf("Expected %q, got %q", c.want, got)
+			}
+		})
+	}
+}
+
+func TestStartRunRegistersFiles(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	started := time.Now().Add(-time.Minute)
+	files := []processor.InputFile{{Path: "a.rot128", SHA256: "abc123", Size: 42}}
+	runID, err := s.StartRun(client.KeyModeTest, "THB", started, files)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// A run that never finishes must still block its files.
+	runs, err := s.FileRuns("abc123", client.KeyModeTest)
+	if err != nil || len(runs) != 1 || runs[0].RunID != runID {
+		t.Fatalf("Expected the started run to register a.rot128, got %+v (%v)", runs, err)
+	}
+
+	result := runResult(time.Now(), []client.DonationOutcome{
+		{ID: "a.rot128:2", DonorID: "card:fp1", Name: "Jane Doe", Amount: money.New(5000, "THB"), Outcome: client.OutcomeSucceeded},
+	}, client.DonorTotal{ID: "card:fp1", Name: "Jane Doe", Amount: money.New(5000, "THB"), Donations: 1})
+	if err := s.FinishRun(runID, result, files); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var count, fileRows int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM runs`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM run_files WHERE run_id = ?`, runID).Scan(&fileRows); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || fileRows != 1 {
+		t.Errorf("Expected the finished run to update its record, got %d runs and %d files", count, fileRows)
+	}
+	if id, _ := s.PreviousCharge(client.KeyModeTest, "card:fp1", money.New(5000, "THB"), "Jane Doe", started); id != "a.rot128:2" {
+		t.Errorf("Expected the finished run's donations to be recorded, got %q", id)
+	}
+}
+
+// runResult builds a one-file test-mode result that finished at finished.
+func runResult(finished time.Time, outcomes []client.DonationOutcome, donors ...client.DonorTotal) *client.RunResult {
+	return &client.RunResult{
+		Mode:     client.KeyModeTest,
+		Started:  finished.Add(-time.Minute),
+		Finished: finished,
+		Currency: "THB",
+		Files:    []client.FileResult{{Path: "a.rot128"}},
+		Summary:  client.Summary{Outcomes: outcomes, Donors: donors},
+	}
+}
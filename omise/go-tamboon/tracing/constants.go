@@ -0,0 +1,16 @@
+package tracing
+
+const (
+	serviceName = "go-tamboon"
+	tracerName  = "go-tamboon"
+
+	exporterNone   = "none"
+	exporterStdout = "stdout"
+	exporterOTLP   = "otlp"
+
+	SpanDonation       = "donation"
+	SpanParse          = "parse"
+	SpanWaitForLimiter = "wait_for_limiter"
+	SpanTokenRequest   = "token_request"
+	SpanChargeRequest  = "charge_request"
+)
@@ -0,0 +1,64 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InitConfig installs the global tracer provider selected by
+// OTEL_TRACES_EXPORTER; the stdout exporter writes to stderr. The returned
+// function flushes pending spans.
+func InitConfig(ctx context.Context) (func(context.Context) error, error) {
+	exporterName := strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER"))
+	if exporterName == "" || exporterName == exporterNone {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// Spans go to stderr so that they never mix with the summary on stdout.
+	exporter, err := newExporter(ctx, exporterName, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
+
+func newExporter(ctx context.Context, name string, w io.Writer) (sdktrace.SpanExporter, error) {
+	switch name {
+	case exporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(w))
+	case exporterOTLP:
+		// The endpoint and headers come from the standard OTEL_EXPORTER_OTLP_* variables.
+		return otlptracehttp.New(ctx)
+	}
+	return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q, expected %s, %s or %s", name, exporterStdout, exporterOTLP, exporterNone)
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base)
+}
@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestInitConfigDisabled(t *testing.T) {
+	t.Setenv("OTEL_TRACES_EXPORTER", "")
+
+	shutdown, err := InitConfig(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestInitConfigUnknownExporter(t *testing.T) {
+	t.Setenv("OTEL_TRACES_EXPORTER", "zipkin")
+
+	if _, err := InitConfig(context.Background()); err == nil {
+		t.Error("Expected error for unknown exporter")
+	}
+}
+
+func TestStdoutExporter(t *testing.T) {
+	var buf bytes.Buffer
+	exporter, err := newExporter(context.Background(), exporterStdout, &buf)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	_, span := provider.Tracer(tracerName).Start(context.Background(), SpanDonation)
+	span.End()
+	provider.Shutdown(context.Background())
+
+	if !strings.Contains(buf.String(), `"Name":"donation"`) {
+		t.Errorf("Expected donation span on stdout, got %s", buf.String())
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var mu sync.Mutex
+	var received [][]byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("Expected /v1/traces, got %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, body)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "otlp")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+
+	oldProvider := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(oldProvider)
+
+	shutdown, err := InitConfig(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	_, span := Tracer().Start(context.Background(), SpanTokenRequest)
+	span.End()
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("Expected spans to be flushed, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) == 0 {
+		t.Fatal("Expected the collector to receive spans")
+	}
+	if !bytes.Contains(received[0], []byte(SpanTokenRequest)) {
+		t.Errorf("Expected exported payload to contain the %s span", SpanTokenRequest)
+	}
+}